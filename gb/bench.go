@@ -0,0 +1,288 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+With --bench=REGEX, the benchmarks matching REGEX are run along with the
+tests, and the ns/op of each one is collected. --bench-save=NAME writes
+them to gb.bench.NAME in the workspace root, and --bench-compare=NAME
+prints how they differ from the ones saved under NAME, marking any that
+got slower by more than --bench-threshold percent (10 by default). If a
+benchmark is run more than once, the mean is used.
+*/
+
+// set by --bench, --bench-save, --bench-compare and --bench-threshold
+var BenchPattern string
+var BenchSave string
+var BenchCompare string
+var BenchThreshold = 10.0
+
+// ns/op of each benchmark run, by target and then benchmark
+type BenchResults map[string]map[string]float64
+
+var benchRuns = make(map[string]map[string][]float64)
+var benchLock sync.Mutex
+
+func Benchmarking() bool {
+	return BenchPattern != ""
+}
+
+// parseBenchmarkLine reads a line like "BenchmarkX-4  1000  1234 ns/op".
+func parseBenchmarkLine(line string) (name string, iterations, nsPerOp float64, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[3] != "ns/op" {
+		return
+	}
+	base := fields[0]
+	if dot := strings.LastIndex(base, "."); dot != -1 {
+		base = base[dot+1:]
+	}
+	if !strings.HasPrefix(base, "Benchmark") {
+		return
+	}
+	var err error
+	if iterations, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return
+	}
+	if nsPerOp, err = strconv.ParseFloat(fields[2], 64); err != nil {
+		return
+	}
+	name, ok = fields[0], true
+	return
+}
+
+// benchName drops the GOMAXPROCS suffix from a benchmark's name, so that
+// results from different machines can be compared.
+func benchName(name string) string {
+	if dash := strings.LastIndex(name, "-"); dash != -1 {
+		if _, err := strconv.Atoi(name[dash+1:]); err == nil {
+			return name[:dash]
+		}
+	}
+	return name
+}
+
+// RecordBenchmarks collects the benchmark results in the output of this
+// target's test binary.
+func (this *Package) RecordBenchmarks(output string) {
+	runs := make(map[string][]float64)
+	for _, line := range strings.Split(output, "\n") {
+		name, _, nsPerOp, ok := parseBenchmarkLine(line)
+		if !ok {
+			continue
+		}
+		name = benchName(name)
+		runs[name] = append(runs[name], nsPerOp)
+	}
+
+	benchLock.Lock()
+	defer benchLock.Unlock()
+	// replaces the results of an earlier run, eg with --watch
+	benchRuns[this.Target] = runs
+}
+
+// CollectBenchmarks averages the runs of each benchmark recorded so far.
+func CollectBenchmarks() (results BenchResults) {
+	benchLock.Lock()
+	defer benchLock.Unlock()
+
+	results = make(BenchResults)
+	for target, benches := range benchRuns {
+		results[target] = make(map[string]float64)
+		for name, runs := range benches {
+			sum := 0.0
+			for _, ns := range runs {
+				sum += ns
+			}
+			results[target][name] = sum / float64(len(runs))
+		}
+	}
+	return
+}
+
+func GetBenchPath(name string) (fpath string) {
+	return filepath.Join(CWD, "gb.bench."+name)
+}
+
+func ReadBenchFile(name string) (results BenchResults, err error) {
+	var fin *os.File
+	fin, err = os.Open(GetBenchPath(name))
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	results = make(BenchResults)
+	br := bufio.NewReader(fin)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) == 3 {
+			ns, perr := strconv.ParseFloat(fields[2], 64)
+			if perr != nil {
+				err = errors.New(fmt.Sprintf("%s: bad line %q", GetBenchPath(name), strings.TrimSpace(line)))
+				return
+			}
+			if results[fields[0]] == nil {
+				results[fields[0]] = make(map[string]float64)
+			}
+			results[fields[0]][fields[1]] = ns
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func sortedKeys(m map[string]float64) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func sortedTargets(results BenchResults) (targets []string) {
+	for target := range results {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return
+}
+
+func WriteBenchFile(name string, results BenchResults) (err error) {
+	var fout *os.File
+	fout, err = os.Create(GetBenchPath(name))
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+
+	for _, target := range sortedTargets(results) {
+		for _, bench := range sortedKeys(results[target]) {
+			if _, err = fmt.Fprintf(fout, "%s %s %.2f\n", target, bench, results[target][bench]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// CompareBenchmarks lays out a table of the benchmarks in saved and current,
+// with the change in each, and marks those that got slower by more than
+// threshold percent. Only targets that were run this time are included.
+func CompareBenchmarks(saved, current BenchResults, threshold float64) (lines []string, regressions int) {
+	rows := [][]string{{"target", "benchmark", "old ns/op", "new ns/op", "delta"}}
+	for _, target := range sortedTargets(current) {
+		names := make(map[string]float64)
+		for bench := range current[target] {
+			names[bench] = 0
+		}
+		for bench := range saved[target] {
+			names[bench] = 0
+		}
+		for _, bench := range sortedKeys(names) {
+			oldns, hasOld := saved[target][bench]
+			newns, hasNew := current[target][bench]
+			row := []string{"\"" + target + "\"", bench, "-", "-", ""}
+			if hasOld {
+				row[2] = strconv.FormatFloat(oldns, 'f', -1, 64)
+			}
+			if hasNew {
+				row[3] = strconv.FormatFloat(newns, 'f', -1, 64)
+			}
+			if hasOld && hasNew && oldns != 0 {
+				delta := 100 * (newns - oldns) / oldns
+				row[4] = fmt.Sprintf("%+.2f%%", delta)
+				if delta > threshold {
+					row[4] += " REGRESSION"
+					regressions++
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for _, row := range rows {
+		var cells []string
+		for i, cell := range row {
+			if i == len(row)-1 {
+				cells = append(cells, cell)
+			} else {
+				cells = append(cells, cell+strings.Repeat(" ", widths[i]-len(cell)))
+			}
+		}
+		lines = append(lines, strings.TrimRight(" "+strings.Join(cells, "  "), " "))
+	}
+	return
+}
+
+// FinishBenchmarks saves and compares the benchmarks run, as asked.
+func FinishBenchmarks() (err error) {
+	results := CollectBenchmarks()
+
+	if BenchCompare != "" {
+		var saved BenchResults
+		if saved, err = ReadBenchFile(BenchCompare); err != nil {
+			return
+		}
+		lines, regressions := CompareBenchmarks(saved, results, BenchThreshold)
+		fmt.Printf("Benchmarks compared with %q:\n", BenchCompare)
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		if regressions == 1 {
+			fmt.Printf("1 benchmark slower by more than %g%%\n", BenchThreshold)
+		} else if regressions > 1 {
+			fmt.Printf("%d benchmarks slower by more than %g%%\n", regressions, BenchThreshold)
+		}
+	}
+
+	if BenchSave != "" {
+		if err = WriteBenchFile(BenchSave, results); err != nil {
+			return
+		}
+		fmt.Printf("Saved benchmarks to %s\n", GetBenchPath(BenchSave))
+	}
+	return
+}
@@ -17,9 +17,10 @@
 package main
 
 import (
-	//"time"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -108,10 +109,7 @@ func BuildPackage(pkg *Package) (err error) {
 		//largs = append(largs, "-o", dst, GetIBName())
 		largs = append(largs, "-o", pkg.Target, GetIBName())
 
-		//startLink := time.Nanoseconds()
 		err = RunExternal(LinkCMD, pkg.Dir, largs)
-		//durLink := time.Nanoseconds()-startLink
-		//fmt.Printf("link took %f\n", float64(durLink)/1e9)
 		dstDir, _ := filepath.Split(pkg.ResultPath)
 		if Verbose {
 			fmt.Printf("Creating directory %s\n", dstDir)
@@ -141,7 +139,7 @@ func BuildPackage(pkg *Package) (err error) {
 
 	return
 }
-func BuildTest(pkg *Package) (err error) {
+func BuildTest(pkg *Package, cover bool, out io.Writer) (err error) {
 
 	reverseDots := ReverseDir(pkg.Dir)
 	pkgDest := filepath.Join(reverseDots, GetBuildDirPkg())
@@ -162,11 +160,18 @@ func BuildTest(pkg *Package) (err error) {
 		}
 		argv = append(argv, "-o", testIB)
 		if testName == pkg.Name {
-			argv = append(argv, pkg.PkgSrc[pkg.Name]...)
+			srcs := pkg.PkgSrc[pkg.Name]
+			if cover {
+				srcs, err = pkg.InstrumentSources(srcs, filepath.Join("_test", "_cover"))
+				if err != nil {
+					return
+				}
+			}
+			argv = append(argv, srcs...)
 		}
 		argv = append(argv, testSrcs...)
 
-		if err = RunExternal(CompileCMD, pkg.Dir, argv); err != nil {
+		if err = RunExternalTo(CompileCMD, pkg.Dir, argv, out, out); err != nil {
 			return
 		}
 
@@ -186,22 +191,27 @@ func BuildTest(pkg *Package) (err error) {
 
 		argv = []string{"grc", dst, testIB}
 
-		if err = RunExternal(PackCMD, pkg.Dir, argv); err != nil {
+		if err = RunExternalTo(PackCMD, pkg.Dir, argv, out, out); err != nil {
 			return
 		}
 
 		return
 	}
 
+	if err = pkg.CheckTestPackages(); err != nil {
+		return
+	}
+	xtestNames, err := pkg.ExternalTestPackages()
+	if err != nil {
+		return
+	}
+
 	err = buildTestName(pkg.Name)
 	if err != nil {
 		return
 	}
 
-	for testName := range pkg.TestSrc {
-		if testName == pkg.Name {
-			continue
-		}
+	for _, testName := range xtestNames {
 		err = buildTestName(testName)
 		if err != nil {
 			return
@@ -219,7 +229,7 @@ func BuildTest(pkg *Package) (err error) {
 	argv = append(argv, "-o", testmainib)
 	argv = append(argv, filepath.Join("_test", "_testmain.go"))
 
-	if err = RunExternal(CompileCMD, pkg.Dir, argv); err != nil {
+	if err = RunExternalTo(CompileCMD, pkg.Dir, argv, out, out); err != nil {
 		return
 	}
 
@@ -236,14 +246,45 @@ func BuildTest(pkg *Package) (err error) {
 	}
 	largs = append(largs, "-o", testBinary, testmainib)
 
-	if err = RunExternal(LinkCMD, pkg.Dir, largs); err != nil {
+	if err = RunExternalTo(LinkCMD, pkg.Dir, largs, out, out); err != nil {
 		return
 	}
 	var testBinaryAbs string
 	testBinaryAbs = GetAbs(filepath.Join(pkg.Dir, testBinary), CWD)
 
-	if err = RunExternal(testBinaryAbs, pkg.Dir, TestArgs); err != nil {
-		ReturnFailCode = true
+	if TestCompileOnly {
+		err = pkg.SaveTestBinary(testBinaryAbs, out)
+		return
+	}
+
+	if cover {
+		// so that counters left by an earlier run are not taken for this one's
+		if rerr := os.Remove(filepath.Join(pkg.Dir, CoverCountsFile)); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+			return
+		}
+	}
+
+	runOut := out
+	var output bytes.Buffer
+	if Benchmarking() {
+		runOut = io.MultiWriter(out, &output)
+	}
+	if JUnitDir != "" {
+		err = pkg.RunTestJUnit(testBinaryAbs, TestArgs, runOut)
+	} else {
+		err = RunExternalTimeout(testBinaryAbs, pkg.Dir, TestArgs, runOut, runOut, TestTimeout)
+	}
+	if Benchmarking() {
+		pkg.RecordBenchmarks(output.String())
+	}
+	if cover {
+		if cerr := pkg.RecordCoverage(out); cerr != nil {
+			ErrLog.Printf("(in %s) could not read coverage: %v\n", pkg.Dir, cerr)
+		}
+	}
+	if err != nil {
+		ReportFailure()
 		return
 	}
 
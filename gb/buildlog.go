@@ -0,0 +1,185 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the file given with --log=FILE
+var BuildLogFile string
+
+// how many of the slowest targets to list at the end of a logged run
+const SlowestTargets = 5
+
+// BuildLogEntry is one line of the --log file.
+type BuildLogEntry struct {
+	Step     string
+	Target   string `json:",omitempty"`
+	Dir      string
+	Argv     []string
+	Exit     int
+	Stderr   string  `json:",omitempty"`
+	Start    string  // RFC 3339, with nanoseconds
+	Duration float64 // seconds
+}
+
+var buildLog *os.File
+var buildLogLock sync.Mutex
+var targetDurations = make(map[string]time.Duration)
+
+func OpenBuildLog() (err error) {
+	if BuildLogFile == "" {
+		return
+	}
+	buildLog, err = os.Create(BuildLogFile)
+	return
+}
+
+func CloseBuildLog() {
+	if buildLog == nil {
+		return
+	}
+	buildLog.Close()
+	buildLog = nil
+}
+
+// StepName describes which part of the build an external command is.
+func StepName(cmd string) (step string) {
+	switch cmd {
+	case CompileCMD:
+		return "compile"
+	case AsmCMD:
+		return "asm"
+	case CCMD:
+		return "cc"
+	case LinkCMD:
+		return "link"
+	case PackCMD:
+		return "pack"
+	case CGoCMD:
+		return "cgo"
+	case GCCCMD:
+		return "gcc"
+	case ProtocCMD:
+		return "protoc"
+	case GoYaccCMD:
+		return "goyacc"
+	case GoInstallCMD:
+		return "goinstall"
+	case MakeCMD:
+		return "make"
+	case CopyCMD:
+		return "copy"
+	}
+	return filepath.Base(cmd)
+}
+
+// TargetForDir finds the target that an external command run in wd is
+// working on. Commands run in a target's _cgo or _test directory count
+// towards that target.
+func TargetForDir(wd string) (target string) {
+	wd = filepath.Clean(wd)
+	base := filepath.Base(wd)
+	if base == CGoDir || base == TestDir {
+		wd = filepath.Dir(wd)
+	}
+	for _, pkg := range Packages {
+		if filepath.Clean(pkg.Dir) == wd {
+			return pkg.Target
+		}
+	}
+	return
+}
+
+// LogExternal records a command that was run. The step is named after cmd,
+// as it was given to RunExternal, while argv is exactly what was executed.
+func LogExternal(cmd, wd string, argv []string, exit int, stderr string, start time.Time, duration time.Duration) {
+	if buildLog == nil {
+		return
+	}
+
+	entry := BuildLogEntry{
+		Step:     StepName(cmd),
+		Target:   TargetForDir(wd),
+		Dir:      wd,
+		Argv:     argv,
+		Exit:     exit,
+		Stderr:   stderr,
+		Start:    start.Format(time.RFC3339Nano),
+		Duration: duration.Seconds(),
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		ErrLog.Println(err)
+		return
+	}
+	line = append(line, '\n')
+
+	buildLogLock.Lock()
+	defer buildLogLock.Unlock()
+
+	if entry.Target != "" {
+		targetDurations[entry.Target] += duration
+	}
+	if _, err = buildLog.Write(line); err != nil {
+		ErrLog.Println(err)
+	}
+}
+
+type targetDuration struct {
+	target   string
+	duration time.Duration
+}
+
+type bySlowest []targetDuration
+
+func (b bySlowest) Len() int      { return len(b) }
+func (b bySlowest) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bySlowest) Less(i, j int) bool {
+	if b[i].duration == b[j].duration {
+		return b[i].target < b[j].target
+	}
+	return b[i].duration > b[j].duration
+}
+
+func PrintSlowestTargets() {
+	if BuildLogFile == "" || len(targetDurations) == 0 {
+		return
+	}
+
+	var tds []targetDuration
+	for target, duration := range targetDurations {
+		tds = append(tds, targetDuration{target, duration})
+	}
+	sort.Sort(bySlowest(tds))
+	if len(tds) > SlowestTargets {
+		tds = tds[:SlowestTargets]
+	}
+
+	fmt.Printf("Slowest targets:\n")
+	for _, td := range tds {
+		fmt.Printf(" %8.3fs \"%s\"\n", td.duration.Seconds(), td.target)
+	}
+}
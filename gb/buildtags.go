@@ -0,0 +1,131 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"os"
+	"strings"
+)
+
+/*
+A source file can restrict when it is built with one or more build
+constraint lines before its package clause,
+
+ // +build linux,386 darwin,!cgo
+
+separated from the package clause (and its documentation) by a blank line.
+The space-separated options on a line are OR'd together, the
+comma-separated terms of an option are AND'd, and a term starting with !
+is negated. Separate +build lines must all be satisfied.
+
+A term is satisfied by $GOOS, $GOARCH, any of gb's unix, posix and bsd
+filename flags that match them, "gc", "go1", "cgo" if cgo is available,
+and any tag given with --tags.
+*/
+
+var ErrExcludedByTags = errors.New("excluded by build constraints")
+
+// tags given with --tags
+var BuildTags = make(map[string]bool)
+
+func AddBuildTags(tags string) {
+	for _, tag := range strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		BuildTags[tag] = true
+	}
+}
+
+func MatchBuildTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	if BuildTags[tag] {
+		return true
+	}
+	switch tag {
+	case "gc", "go1":
+		return true
+	case "cgo":
+		return GCCCMD != "" && os.Getenv("CGO_ENABLED") != "0"
+	}
+	return CheckCGOFlag(tag)
+}
+
+func matchBuildTerm(term string) bool {
+	if strings.HasPrefix(term, "!!") {
+		return false
+	}
+	if strings.HasPrefix(term, "!") {
+		tag := term[1:]
+		return tag != "" && !MatchBuildTag(tag)
+	}
+	return MatchBuildTag(term)
+}
+
+// MatchBuildLine evaluates the text following "+build".
+func MatchBuildLine(line string) bool {
+	for _, option := range strings.Fields(line) {
+		matched := true
+		for _, term := range strings.Split(option, ",") {
+			if !matchBuildTerm(term) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildConstraints returns the text of each +build line in the file's
+// header.
+func BuildConstraints(file *ast.File) (lines []string) {
+	for _, group := range file.Comments {
+		if group.Pos() >= file.Package {
+			break
+		}
+		if group == file.Doc {
+			// no blank line between it and the package clause
+			continue
+		}
+		for _, c := range group.List {
+			text := c.Text
+			if !strings.HasPrefix(text, "//") {
+				continue
+			}
+			text = strings.TrimSpace(text[2:])
+			if strings.HasPrefix(text, "+build ") || text == "+build" {
+				lines = append(lines, strings.TrimSpace(text[len("+build"):]))
+			}
+		}
+	}
+	return
+}
+
+func MatchBuildConstraints(lines []string) bool {
+	for _, line := range lines {
+		if !MatchBuildLine(line) {
+			return false
+		}
+	}
+	return true
+}
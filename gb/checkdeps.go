@@ -0,0 +1,154 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+With --check-deps, nothing is built. Instead, for each listed target, every
+import that could not be resolved is listed under the source file that
+has it, test source included, along with why. Then the workspace packages
+that are not imported, directly or through other targets, by any listed
+target are listed as unused.
+*/
+
+// set by --check-deps
+var DepCheck bool
+
+// why an import could not be resolved
+const (
+	NotGoInstallable = "is not in the workspace or GOROOT/pkg, and is not goinstallable"
+	NotGoInstalled   = "is not in the workspace or GOROOT/pkg; it is goinstallable, but -g was not given"
+)
+
+func (this *Package) unresolved(dep, reason string) {
+	// build order markers, like "cgo"-cmd, are not imports
+	if strings.HasSuffix(dep, "-cmd") {
+		return
+	}
+	this.Unresolved[dep] = reason
+}
+
+func sortedSources(srcDeps map[string][]string) (srcs []string) {
+	for src := range srcDeps {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+	return
+}
+
+// UnresolvedImports describes each unresolved import, with the source file
+// that has it.
+func (this *Package) UnresolvedImports() (lines []string) {
+	for _, srcDeps := range []map[string][]string{this.SrcDeps, this.TestSrcDeps} {
+		for _, src := range sortedSources(srcDeps) {
+			seen := make(map[string]bool)
+			for _, dep := range srcDeps[src] {
+				reason, ok := this.Unresolved[this.resolveRelative(dep)]
+				if !ok || seen[dep] {
+					continue
+				}
+				seen[dep] = true
+				lines = append(lines, fmt.Sprintf("%s: %s %s", src, dep, reason))
+			}
+		}
+	}
+	return
+}
+
+// UnusedPackages returns the packages in pkgs that none of listed import,
+// directly or not. A listed package only counts as used if another listed
+// package imports it.
+func UnusedPackages(pkgs, listed []*Package) (unused []*Package) {
+	used := make(map[*Package]bool)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		for _, deps := range [][]*Package{pkg.DepPkgs, pkg.TestDepPkgs} {
+			for _, dep := range deps {
+				if !used[dep] {
+					used[dep] = true
+					visit(dep)
+				}
+			}
+		}
+	}
+	for _, pkg := range listed {
+		visit(pkg)
+	}
+
+	for _, pkg := range pkgs {
+		if !used[pkg] {
+			unused = append(unused, pkg)
+		}
+	}
+	sort.Sort(byPkgTarget(unused))
+	return
+}
+
+func ReportDeps() (err error) {
+	listed := append([]*Package{}, ListedPkgs...)
+	sort.Sort(byPkgTarget(listed))
+
+	count := 0
+	for _, pkg := range listed {
+		lines := pkg.UnresolvedImports()
+		if len(lines) == 0 {
+			continue
+		}
+		count += len(lines)
+		fmt.Printf("(in %s) \"%s\" has unresolved imports:\n", pkg.Dir, pkg.Target)
+		for _, line := range lines {
+			fmt.Printf(" %s\n", line)
+		}
+	}
+
+	var workspace []*Package
+	for _, pkg := range Packages {
+		if pkg.IsCmd || pkg.IsInGOROOT || pkg.IsInGOPATH != "" || pkg.InTestData != "" {
+			continue
+		}
+		workspace = append(workspace, pkg)
+	}
+	unused := UnusedPackages(workspace, listed)
+	if len(unused) != 0 {
+		fmt.Printf("Packages not imported by any listed target:\n")
+		for _, pkg := range unused {
+			fmt.Printf(" \"%s\" in %s\n", pkg.Target, pkg.Dir)
+		}
+	}
+
+	if count == 1 {
+		err = errors.New("1 unresolved import")
+	} else if count > 1 {
+		err = errors.New(fmt.Sprintf("%d unresolved imports", count))
+	} else if len(unused) == 0 {
+		fmt.Printf("All imports resolved, and every package is used\n")
+	}
+	return
+}
+
+func TryCheckDeps() (err error) {
+	if DepCheck {
+		err = ReportDeps()
+	}
+	return
+}
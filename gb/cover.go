@@ -0,0 +1,396 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+With --cover, the build source of a target is copied into _test/_cover
+before its test is compiled, with a counter added to the start of every
+run of statements that is always executed together. The counters live in
+an array, CoverVar, declared in one more generated file. The generated
+test main writes the counters to _test/_cover.out after each test, and gb
+matches them back up with the statements they count.
+
+Each target's statement coverage is printed after its test runs, and the
+counts for every target tested are written to a single profile in the
+format used by "go tool cover".
+*/
+
+// the name of the counter array added to an instrumented package
+const CoverVar = "GbCoverCount__"
+
+// the prefix of the labels added for a break or continue, when the
+// original label has been moved onto a counter
+const CoverLabel = "GbCoverLabel__"
+
+// where the test main writes the counters, relative to the target's dir
+var CoverCountsFile = filepath.Join("_test", "_cover.out")
+
+// set by --cover
+var Cover bool
+
+// the profile given with --cover=FILE, relative to where gb was run. If
+// none is given, cover.out in the workspace root is used.
+var CoverProfileFile string
+
+type CoverBlock struct {
+	File                string
+	StartLine, StartCol int
+	EndLine, EndCol     int
+	NumStmt             int
+}
+
+// the profile lines of each target tested, by target
+var coverProfile = make(map[string][]string)
+var coverLock sync.Mutex
+
+// endsBlock reports whether control might not continue on to the statement
+// after s, or might arrive at it from somewhere else.
+func endsBlock(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.LabeledStmt:
+		return endsBlock(s.Stmt)
+	case *ast.ReturnStmt, *ast.BranchStmt, *ast.IfStmt, *ast.ForStmt,
+		*ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt,
+		*ast.SelectStmt, *ast.BlockStmt:
+		return true
+	}
+	return false
+}
+
+func coverCounter(index int) ast.Stmt {
+	return &ast.IncDecStmt{
+		X: &ast.IndexExpr{
+			X:     ast.NewIdent(CoverVar),
+			Index: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(index)},
+		},
+		Tok: token.INC,
+	}
+}
+
+// eachBranch calls f for each branch statement in body that is not in a
+// function literal, since labels belong to the function they are in.
+func eachBranch(body ast.Node, f func(b *ast.BranchStmt)) {
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncLit:
+			return n == body
+		case *ast.BranchStmt:
+			if n.Label != nil {
+				f(n)
+			}
+		}
+		return true
+	})
+}
+
+// gotoTargets finds the labeled statements in file that a goto jumps to.
+func gotoTargets(file *ast.File) (targets map[*ast.LabeledStmt]bool) {
+	targets = make(map[*ast.LabeledStmt]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		var body ast.Node
+		switch n := node.(type) {
+		case *ast.FuncDecl:
+			if n.Body != nil {
+				body = n.Body
+			}
+		case *ast.FuncLit:
+			body = n
+		}
+		if body == nil {
+			return true
+		}
+		labels := make(map[string]*ast.LabeledStmt)
+		ast.Inspect(body, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.FuncLit:
+				return n == body
+			case *ast.LabeledStmt:
+				labels[n.Label.Name] = n
+			}
+			return true
+		})
+		eachBranch(body, func(b *ast.BranchStmt) {
+			if l, ok := labels[b.Label.Name]; ok && b.Tok == token.GOTO {
+				targets[l] = true
+			}
+		})
+		return true
+	})
+	return
+}
+
+// countAfterLabel puts the counter after the label of l, so that a goto
+// to it is counted too. A break or continue has to name the statement
+// itself, so if there are any, it is given a label of its own for them.
+func countAfterLabel(l *ast.LabeledStmt, counter ast.Stmt) (stmts []ast.Stmt) {
+	stmts = append(stmts, &ast.LabeledStmt{Label: l.Label, Stmt: counter})
+	inner := &ast.LabeledStmt{Label: ast.NewIdent(CoverLabel + l.Label.Name), Stmt: l.Stmt}
+	relabeled := false
+	eachBranch(l.Stmt, func(b *ast.BranchStmt) {
+		if b.Tok != token.GOTO && b.Label.Name == l.Label.Name {
+			b.Label = ast.NewIdent(inner.Label.Name)
+			relabeled = true
+		}
+	})
+	if relabeled {
+		stmts = append(stmts, inner)
+	} else {
+		stmts = append(stmts, l.Stmt)
+	}
+	return
+}
+
+// instrumentList puts a counter in front of each run of statements in list,
+// and records a block for each one. A run that starts with a label that
+// is in gotos gets its counter after the label instead.
+func instrumentList(fset *token.FileSet, name string, list []ast.Stmt, gotos map[*ast.LabeledStmt]bool, blocks *[]CoverBlock) (newlist []ast.Stmt) {
+	var run []ast.Stmt
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		start := fset.Position(run[0].Pos())
+		end := fset.Position(run[len(run)-1].End())
+		counter := coverCounter(len(*blocks))
+		if l, ok := run[0].(*ast.LabeledStmt); ok && gotos[l] {
+			newlist = append(newlist, countAfterLabel(l, counter)...)
+			newlist = append(newlist, run[1:]...)
+		} else {
+			newlist = append(newlist, counter)
+			newlist = append(newlist, run...)
+		}
+		*blocks = append(*blocks, CoverBlock{
+			File:      name,
+			StartLine: start.Line,
+			StartCol:  start.Column,
+			EndLine:   end.Line,
+			EndCol:    end.Column,
+			NumStmt:   len(run),
+		})
+		run = nil
+	}
+	for _, s := range list {
+		if _, isLabel := s.(*ast.LabeledStmt); isLabel {
+			// a label can be jumped to, so it starts a new run
+			flush()
+		}
+		run = append(run, s)
+		if endsBlock(s) {
+			flush()
+		}
+	}
+	flush()
+	return
+}
+
+// InstrumentFile adds counters to every function body in file. The blocks
+// are named after name, and numbered on from those already in blocks.
+func InstrumentFile(fset *token.FileSet, file *ast.File, name string, blocks *[]CoverBlock) {
+	gotos := gotoTargets(file)
+	// the bodies of these hold clauses, not statements
+	clauses := make(map[*ast.BlockStmt]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.SwitchStmt:
+			clauses[n.Body] = true
+		case *ast.TypeSwitchStmt:
+			clauses[n.Body] = true
+		case *ast.SelectStmt:
+			clauses[n.Body] = true
+		case *ast.BlockStmt:
+			if !clauses[n] {
+				n.List = instrumentList(fset, name, n.List, gotos, blocks)
+			}
+		case *ast.CaseClause:
+			n.Body = instrumentList(fset, name, n.Body, gotos, blocks)
+		case *ast.CommClause:
+			n.Body = instrumentList(fset, name, n.Body, gotos, blocks)
+		}
+		return true
+	})
+}
+
+// InstrumentSources writes instrumented copies of the target's build
+// source into dir, which is relative to the target's directory, and
+// returns the files to compile in their place.
+func (this *Package) InstrumentSources(srcs []string, dir string) (cvrsrcs []string, err error) {
+	this.CoverBlocks = nil
+
+	absdir := filepath.Join(this.Dir, dir)
+	if err = os.MkdirAll(absdir, 0755); err != nil {
+		return
+	}
+
+	fset := token.NewFileSet()
+	for _, src := range srcs {
+		var file *ast.File
+		file, err = parser.ParseFile(fset, filepath.Join(this.Dir, src), nil, 0)
+		if err != nil {
+			return
+		}
+		InstrumentFile(fset, file, this.Target+"/"+filepath.ToSlash(src), &this.CoverBlocks)
+
+		var fout *os.File
+		fout, err = os.Create(filepath.Join(absdir, filepath.Base(src)))
+		if err != nil {
+			return
+		}
+		err = printer.Fprint(fout, fset, file)
+		fout.Close()
+		if err != nil {
+			return
+		}
+		cvrsrcs = append(cvrsrcs, filepath.Join(dir, filepath.Base(src)))
+	}
+
+	varsrc := filepath.Join(dir, "_cover_vars.go")
+	var fout *os.File
+	fout, err = os.Create(filepath.Join(this.Dir, varsrc))
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(fout, "package %s\n\nvar %s [%d]uint32\n", this.Name, CoverVar, len(this.CoverBlocks))
+	fout.Close()
+	cvrsrcs = append(cvrsrcs, varsrc)
+	return
+}
+
+// ReadCoverCounts reads the counters written by an instrumented test.
+func ReadCoverCounts(fpath string) (counts []int, err error) {
+	var fin *os.File
+	fin, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	br := bufio.NewReader(fin)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" {
+			count, cerr := strconv.Atoi(line)
+			if cerr != nil {
+				err = cerr
+				return
+			}
+			counts = append(counts, count)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// RecordCoverage reads the counters left by this target's test, prints
+// how much of it was covered, and adds it to the profile.
+func (this *Package) RecordCoverage(out io.Writer) (err error) {
+	counts, err := ReadCoverCounts(filepath.Join(this.Dir, CoverCountsFile))
+	if os.IsNotExist(err) {
+		// no tests were run
+		counts, err = make([]int, len(this.CoverBlocks)), nil
+	}
+	if err != nil {
+		return
+	}
+	if len(counts) != len(this.CoverBlocks) {
+		err = errors.New(fmt.Sprintf("expected %d coverage counters, found %d", len(this.CoverBlocks), len(counts)))
+		return
+	}
+
+	var lines []string
+	total, covered := 0, 0
+	for i, b := range this.CoverBlocks {
+		total += b.NumStmt
+		if counts[i] != 0 {
+			covered += b.NumStmt
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d.%d,%d.%d %d %d",
+			b.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt, counts[i]))
+	}
+
+	percent := 100.0
+	if total != 0 {
+		percent = 100 * float64(covered) / float64(total)
+	}
+	fmt.Fprintf(out, "(in %s) coverage of \"%s\": %.1f%% of statements\n", this.Dir, this.Target, percent)
+
+	coverLock.Lock()
+	coverProfile[this.Target] = lines
+	coverLock.Unlock()
+	return
+}
+
+// WriteCoverProfile writes the counts for every target tested with
+// --cover to CoverProfileFile.
+func WriteCoverProfile() (err error) {
+	coverLock.Lock()
+	defer coverLock.Unlock()
+
+	if len(coverProfile) == 0 {
+		return
+	}
+
+	fpath := filepath.Join(CWD, "cover.out")
+	if CoverProfileFile != "" {
+		fpath = GetAbs(CoverProfileFile, OSWD)
+	}
+
+	var fout *os.File
+	fout, err = os.Create(fpath)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+
+	var targets []string
+	for target := range coverProfile {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	fmt.Fprintf(fout, "mode: count\n")
+	for _, target := range targets {
+		for _, line := range coverProfile[target] {
+			fmt.Fprintf(fout, "%s\n", line)
+		}
+	}
+	fmt.Printf("Wrote coverage profile to %s\n", fpath)
+	return
+}
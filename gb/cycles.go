@@ -0,0 +1,211 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+type ImportSite struct {
+	From, To *Package
+	Srcs     []string // the files in From that import To
+}
+
+type ImportCycle struct {
+	Pkgs  []*Package // sorted by target
+	Sites []ImportSite
+}
+
+type byPkgTarget []*Package
+
+func (b byPkgTarget) Len() int      { return len(b) }
+func (b byPkgTarget) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPkgTarget) Less(i, j int) bool {
+	if b[i].Target == b[j].Target {
+		return b[i].Dir < b[j].Dir
+	}
+	return b[i].Target < b[j].Target
+}
+
+// ImportKey is the key that other targets' imports of this one resolve to
+// in Packages.
+func (this *Package) ImportKey() (key string) {
+	key = "\"" + this.Target + "\""
+	if this.IsCmd {
+		key += "-cmd"
+	}
+	return
+}
+
+// ImportingSources returns the source files of this target that import
+// dep, with relative imports resolved the same way ResolveDeps does.
+func (this *Package) ImportingSources(dep *Package) (srcs []string) {
+	key := dep.ImportKey()
+	for src, deps := range this.SrcDeps {
+		for _, d := range deps {
+			if strings.HasPrefix(d, "\"./") {
+				d = "\"" + path.Join(this.Base, d[1:len(d)-1]) + "\""
+			}
+			if d == key {
+				srcs = append(srcs, src)
+				break
+			}
+		}
+	}
+	sort.Strings(srcs)
+	return
+}
+
+/*
+FindCycles returns every import cycle among pkgs, as the strongly connected
+components of the DepPkgs graph (found with Tarjan's algorithm), along with
+each import inside the component and the files that make it.
+*/
+func FindCycles(pkgs []*Package) (cycles []*ImportCycle) {
+	index := make(map[*Package]int)
+	lowlink := make(map[*Package]int)
+	onStack := make(map[*Package]bool)
+	var stack []*Package
+	next := 0
+
+	var strongConnect func(pkg *Package)
+	strongConnect = func(pkg *Package) {
+		index[pkg] = next
+		lowlink[pkg] = next
+		next++
+		stack = append(stack, pkg)
+		onStack[pkg] = true
+
+		for _, dep := range pkg.DepPkgs {
+			if _, seen := index[dep]; !seen {
+				strongConnect(dep)
+				if lowlink[dep] < lowlink[pkg] {
+					lowlink[pkg] = lowlink[dep]
+				}
+			} else if onStack[dep] && index[dep] < lowlink[pkg] {
+				lowlink[pkg] = index[dep]
+			}
+		}
+
+		if lowlink[pkg] != index[pkg] {
+			return
+		}
+
+		var component []*Package
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == pkg {
+				break
+			}
+		}
+
+		selfImport := false
+		for _, dep := range pkg.DepPkgs {
+			if dep == pkg {
+				selfImport = true
+			}
+		}
+		if len(component) > 1 || selfImport {
+			cycles = append(cycles, newImportCycle(component))
+		}
+	}
+
+	sorted := append([]*Package{}, pkgs...)
+	sort.Sort(byPkgTarget(sorted))
+	for _, pkg := range sorted {
+		if _, seen := index[pkg]; !seen {
+			strongConnect(pkg)
+		}
+	}
+
+	sort.Sort(byCycle(cycles))
+	return
+}
+
+func newImportCycle(component []*Package) (cycle *ImportCycle) {
+	cycle = &ImportCycle{}
+	cycle.Pkgs = append(cycle.Pkgs, component...)
+	sort.Sort(byPkgTarget(cycle.Pkgs))
+
+	in := make(map[*Package]bool)
+	for _, pkg := range cycle.Pkgs {
+		in[pkg] = true
+	}
+	for _, from := range cycle.Pkgs {
+		deps := append([]*Package{}, from.DepPkgs...)
+		sort.Sort(byPkgTarget(deps))
+		var last *Package
+		for _, to := range deps {
+			if !in[to] || to == last {
+				continue
+			}
+			last = to
+			cycle.Sites = append(cycle.Sites, ImportSite{
+				From: from,
+				To:   to,
+				Srcs: from.ImportingSources(to),
+			})
+		}
+	}
+	return
+}
+
+type byCycle []*ImportCycle
+
+func (b byCycle) Len() int      { return len(b) }
+func (b byCycle) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCycle) Less(i, j int) bool {
+	return byPkgTarget{b[i].Pkgs[0], b[j].Pkgs[0]}.Less(0, 1)
+}
+
+func (this *ImportCycle) String() string {
+	var targets []string
+	for _, pkg := range this.Pkgs {
+		targets = append(targets, pkg.Target)
+	}
+	lines := []string{fmt.Sprintf("Cycle detected among %v", targets)}
+	for _, site := range this.Sites {
+		srcs := "(unknown source)"
+		if len(site.Srcs) != 0 {
+			srcs = strings.Join(site.Srcs, ", ")
+		}
+		lines = append(lines, fmt.Sprintf(" (in %s) %s imports \"%s\"", site.From.Dir, srcs, site.To.Target))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func CycleError(cycles []*ImportCycle) (err error) {
+	if len(cycles) == 0 {
+		return
+	}
+	var msgs []string
+	if len(cycles) > 1 {
+		msgs = append(msgs, fmt.Sprintf("%d import cycles detected", len(cycles)))
+	}
+	for _, cycle := range cycles {
+		msgs = append(msgs, cycle.String())
+	}
+	err = errors.New(strings.Join(msgs, "\n"))
+	return
+}
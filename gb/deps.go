@@ -22,14 +22,58 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"os"
 	"strings"
 )
 
-func GetDeps(source string) (pkg, target string, deps, funcs, cflags, ldflags []string, err error) {
+func GetDeps(source string) (pkg, target string, deps, funcs []string, outputs map[string]string, cflags, ldflags []string, err error) {
 	isTest := strings.HasSuffix(source, "_test.go") && Test
+
+	var info *SourceInfo
+	fi, serr := os.Stat(source)
+	cached := false
+	if serr == nil {
+		info, cached = LookupSource(source, fi, isTest)
+	}
+	if !cached {
+		info, err = ParseSource(source, isTest)
+		if err != nil {
+			return
+		}
+		if serr == nil {
+			StoreSource(source, fi, info)
+		}
+	}
+
+	// copies, since the cached info may be handed out again
+	deps = append([]string{}, info.Deps...)
+	pkg = info.Name
+	target = info.Target
+	funcs = []string{}
+	outputs = make(map[string]string)
+	if isTest {
+		funcs = append(funcs, info.Funcs...)
+		for f, output := range info.Outputs {
+			outputs[f] = output
+		}
+	}
+	cflags, ldflags = CGoFlags(info.CGoLines)
+	cflags = RemoveDups(cflags)
+	ldflags = RemoveDups(ldflags)
+
+	if !MatchBuildConstraints(info.BuildLines) {
+		err = ErrExcludedByTags
+	}
+
+	return
+}
+
+// ParseSource reads what gb needs to know from a source file, without
+// regard to the platform or tags, so that the result can be cached.
+func ParseSource(source string, scanFuncs bool) (info *SourceInfo, err error) {
 	var file *ast.File
 	flag := parser.ParseComments
-	if !isTest {
+	if !scanFuncs {
 		flag = flag | parser.ImportsOnly
 	}
 	file, err = parser.ParseFile(token.NewFileSet(), source, nil, flag)
@@ -38,25 +82,95 @@ func GetDeps(source string) (pkg, target string, deps, funcs, cflags, ldflags []
 	}
 
 	w := &Walker{
-		Name:       "",
-		Target:     "",
-		pkgPos:     0,
-		Deps:       []string{},
-		Funcs:      []string{},
-		CGoLDFlags: []string{},
-		CGoCFlags:  []string{},
-		ScanFuncs:  isTest,
+		Name:      "",
+		Target:    "",
+		pkgPos:    0,
+		Deps:      []string{},
+		Funcs:     []string{},
+		CGoLines:  []string{},
+		ScanFuncs: scanFuncs,
 	}
 
 	ast.Walk(w, file)
+	w.BuildLines = BuildConstraints(file)
 
-	deps = w.Deps
-	pkg = w.Name
-	target = w.Target
-	funcs = w.Funcs
-	cflags = RemoveDups(w.CGoCFlags)
-	ldflags = RemoveDups(w.CGoLDFlags)
+	info = &SourceInfo{
+		ScanFuncs:  scanFuncs,
+		Name:       w.Name,
+		Target:     w.Target,
+		Deps:       w.Deps,
+		Funcs:      w.Funcs,
+		Outputs:    ExampleOutputs(file),
+		CGoLines:   w.CGoLines,
+		BuildLines: w.BuildLines,
+	}
+	return
+}
 
+// ExampleOutputs finds the example functions in file that end with an
+// "Output:" comment, and the output each one expects. As with gotest,
+// examples without one are compiled but not run.
+func ExampleOutputs(file *ast.File) (outputs map[string]string) {
+	outputs = make(map[string]string)
+	for _, decl := range file.Decls {
+		fdecl, ok := decl.(*ast.FuncDecl)
+		if !ok || fdecl.Recv != nil || !strings.HasPrefix(fdecl.Name.Name, "Example") {
+			continue
+		}
+		if fdecl.Body == nil || fdecl.Type.Params.NumFields() != 0 || fdecl.Type.Results.NumFields() != 0 {
+			continue
+		}
+
+		// the last comment in the function
+		var last *ast.CommentGroup
+		for _, group := range file.Comments {
+			if group.Pos() < fdecl.Body.Lbrace {
+				continue
+			}
+			if group.End() > fdecl.Body.Rbrace {
+				break
+			}
+			last = group
+		}
+		if last == nil {
+			continue
+		}
+
+		text := last.Text()
+		trimmed := strings.TrimLeft(text, " \t\n")
+		if len(trimmed) >= len("Output:") && strings.EqualFold(trimmed[:len("Output:")], "Output:") {
+			outputs[fdecl.Name.Name] = strings.TrimSpace(trimmed[len("Output:"):])
+		}
+	}
+	return
+}
+
+// CGoFlags picks out the CFLAGS and LDFLAGS of the #cgo lines that apply
+// to the platform being built for.
+func CGoFlags(lines []string) (cflags, ldflags []string) {
+	cflags = []string{}
+	ldflags = []string{}
+	for _, line := range lines {
+		cgoMsg := strings.TrimSpace(line[len("#cgo"):])
+
+		fields := strings.Fields(cgoMsg)
+		if len(fields) >= 1 {
+			flag := fields[0]
+			if !strings.HasSuffix(flag, ":") {
+				if !CheckCGOFlag(flag) {
+					continue
+				} else {
+					cgoMsg = strings.TrimSpace(cgoMsg[len(flag):])
+				}
+			}
+		}
+
+		if strings.HasPrefix(cgoMsg, "CFLAGS:") {
+			cflags = append(cflags, strings.TrimSpace(cgoMsg[len("CFLAGS:"):]))
+		} else if strings.HasPrefix(cgoMsg, "LDFLAGS:") {
+			ldflags = append(ldflags, strings.TrimSpace(cgoMsg[len("LDFLAGS:"):]))
+		}
+	}
 	return
 }
 
@@ -78,9 +192,9 @@ type Walker struct {
 	pkgPos     token.Pos
 	Deps       []string
 	Funcs      []string
-	CGoLDFlags []string
-	CGoCFlags  []string
+	CGoLines   []string
 	ScanFuncs  bool
+	BuildLines []string
 }
 
 func (w *Walker) Visit(node ast.Node) (v ast.Visitor) {
@@ -111,36 +225,7 @@ func (w *Walker) Visit(node ast.Node) (v ast.Visitor) {
 
 			handleCommentLine := func(text string) {
 				if strings.HasPrefix(text, "#cgo") {
-					cgoMsg := strings.TrimSpace(text[len("#cgo"):])
-
-					fields := strings.Fields(cgoMsg)
-					if len(fields) >= 1 {
-						flag := fields[0]
-						if !strings.HasSuffix(flag, ":") {
-							if !CheckCGOFlag(flag) {
-								return
-							} else {
-								cgoMsg = strings.TrimSpace(cgoMsg[len(flag):])
-							}
-						}
-					}
-
-					cflags := false
-					lflags := false
-					if strings.HasPrefix(cgoMsg, "CFLAGS:") {
-						cflags = true
-						cgoMsg = strings.TrimSpace(cgoMsg[len("CFLAGS:"):])
-					} else if strings.HasPrefix(cgoMsg, "LDFLAGS:") {
-						lflags = true
-						cgoMsg = strings.TrimSpace(cgoMsg[len("LDFLAGS:"):])
-					}
-
-					if cflags {
-						w.CGoCFlags = append(w.CGoCFlags, cgoMsg)
-					}
-					if lflags {
-						w.CGoLDFlags = append(w.CGoLDFlags, cgoMsg)
-					}
+					w.CGoLines = append(w.CGoLines, text)
 				}
 			}
 
@@ -0,0 +1,286 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+A target's digest covers the contents of its build source, the digests of
+the workspace targets it imports, the archives of any GOROOT or goinstalled
+packages it imports, and the flags and platform it is built with. The
+digest of every successful build is recorded in the manifest, and a target
+is only rebuilt when its digest differs from the recorded one (or when its
+result has gone missing).
+*/
+
+const ManifestName = "gb.manifest"
+
+var manifest = make(map[string]string)
+var manifestLock sync.Mutex
+
+var archiveDigests = make(map[string]string)
+var archiveDigestsLock sync.Mutex
+
+func GetManifestPath() (p string) {
+	return filepath.Join(GetBuildDirPkg(), ManifestName)
+}
+
+func ReadManifest() (err error) {
+	var fin *os.File
+	fin, err = os.Open(GetManifestPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer fin.Close()
+
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	br := bufio.NewReader(fin)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) == 2 {
+				manifest[fields[1]] = fields[0]
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func WriteManifest() (err error) {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	mpath := GetManifestPath()
+	mdir, _ := filepath.Split(mpath)
+	if mdir != "" {
+		os.MkdirAll(mdir, 0755)
+	}
+
+	var fout *os.File
+	fout, err = os.Create(mpath)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+
+	dirs := []string{}
+	for dir := range manifest {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		fmt.Fprintf(fout, "%s %s\n", manifest[dir], dir)
+	}
+	return
+}
+
+func ManifestDigest(pkg *Package) (digest string) {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	digest = manifest[pkg.Dir]
+	return
+}
+
+func RecordDigest(pkg *Package) (err error) {
+	manifestLock.Lock()
+	manifest[pkg.Dir] = pkg.Digest
+	manifestLock.Unlock()
+
+	err = WriteManifest()
+	return
+}
+
+func ForgetDigest(pkg *Package) {
+	manifestLock.Lock()
+	delete(manifest, pkg.Dir)
+	manifestLock.Unlock()
+}
+
+func hashFile(h hash.Hash, fpath string) (err error) {
+	var fin *os.File
+	fin, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+	_, err = io.Copy(h, fin)
+	return
+}
+
+func GOROOTArchive(target string) (archive string) {
+	target = strings.Trim(target, "\"")
+	archive = path.Join(GetGOROOTDirPkg(), target) + ".a"
+	return
+}
+
+func InstalledArchive(target string) (archive string) {
+	target = strings.Trim(target, "\"")
+	archive = path.Join(GetInstallDirPkg(), target) + ".a"
+	return
+}
+
+// ArchiveDigest returns the digest of an archive that gb does not build
+// itself, or "" if it does not exist.
+func ArchiveDigest(archive string) (digest string) {
+	archiveDigestsLock.Lock()
+	defer archiveDigestsLock.Unlock()
+
+	if d, ok := archiveDigests[archive]; ok {
+		return d
+	}
+	h := sha1.New()
+	if err := hashFile(h, archive); err == nil {
+		digest = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	archiveDigests[archive] = digest
+	return
+}
+
+// ForgetArchiveDigest is used when an archive is replaced, eg by goinstall.
+func ForgetArchiveDigest(archive string) {
+	archiveDigestsLock.Lock()
+	delete(archiveDigests, archive)
+	archiveDigestsLock.Unlock()
+}
+
+func (this *Package) DigestSources() (srcs []string) {
+	istest := make(map[string]bool)
+	for _, src := range this.TestSources {
+		istest[src] = true
+	}
+	for _, src := range this.Sources {
+		if !istest[src] {
+			srcs = append(srcs, src)
+		}
+	}
+	srcs = append(srcs, this.CHeaders...)
+	if this.HasMakefile {
+		if _, err := os.Stat(path.Join(this.Dir, "Makefile")); err == nil {
+			srcs = append(srcs, "Makefile")
+		} else {
+			srcs = append(srcs, "makefile")
+		}
+	}
+	sort.Strings(srcs)
+	return
+}
+
+func (this *Package) ComputeDigest() (digest string) {
+	this.digestLock.Lock()
+	defer this.digestLock.Unlock()
+
+	if this.digested {
+		return this.Digest
+	}
+	this.digested = true
+
+	h := sha1.New()
+
+	fmt.Fprintf(h, "target %s\n", this.Target)
+	fmt.Fprintf(h, "platform %s_%s\n", GOOS, GOARCH)
+	fmt.Fprintf(h, "GCFLAGS %v\n", GCFLAGS)
+	if this.IsCmd {
+		fmt.Fprintf(h, "GLDFLAGS %v\n", GLDFLAGS)
+	}
+	if gcflags, set := this.Cfg.GCFlags(); set {
+		fmt.Fprintf(h, "gcflags %s\n", gcflags)
+	}
+	if plugin, set := this.Cfg.ProtobufPlugin(); set {
+		fmt.Fprintf(h, "proto %s\n", plugin)
+	}
+
+	for _, src := range this.DigestSources() {
+		fmt.Fprintf(h, "src %s\n", src)
+		if err := hashFile(h, path.Join(this.Dir, src)); err != nil {
+			fmt.Fprintf(h, "missing\n")
+		}
+	}
+
+	// DepPkgs comes from RemoveDups, in no particular order
+	deps := append([]*Package{}, this.DepPkgs...)
+	sort.Sort(byPkgTarget(deps))
+	for _, pkg := range deps {
+		fmt.Fprintf(h, "dep %s %s\n", pkg.Target, pkg.ComputeDigest())
+	}
+
+	archives := append([]string{}, this.ExtArchives...)
+	sort.Strings(archives)
+	for _, archive := range archives {
+		fmt.Fprintf(h, "archive %s %s\n", archive, ArchiveDigest(archive))
+	}
+
+	this.Digest = fmt.Sprintf("%x", h.Sum(nil))
+	return this.Digest
+}
+
+// ForgetComputedDigest makes the digest be computed again, for this target
+// and every target that imports it, directly or not, since their digests
+// cover this one's.
+func (this *Package) ForgetComputedDigest() {
+	this.digestLock.Lock()
+	digested := this.digested
+	this.digested = false
+	this.digestLock.Unlock()
+	// a target's digest is never computed without those of its imports
+	if !digested {
+		return
+	}
+
+	for _, pkg := range Packages {
+		for _, dep := range pkg.DepPkgs {
+			if dep == this {
+				pkg.ForgetComputedDigest()
+				break
+			}
+		}
+	}
+}
+
+// Stale reports whether the target's result is missing or was built from
+// something other than what is currently in the workspace.
+func (this *Package) Stale() bool {
+	if this.BinTime == 0 {
+		return true
+	}
+	return ManifestDigest(this) != this.ComputeDigest()
+}
@@ -71,6 +71,13 @@ gb will match target names with import statements found in the source to
 determine the workspace dependency structure. It will use this structure to 
 do incremental building correctly.
 
+Whether a target is up to date is decided by a digest of the contents of its
+source files, the digests of the targets it imports, the archives of any
+other packages it imports, its compile flags and $GOOS/$GOARCH. The digest
+of each successful build is recorded in _obj/gb.manifest, so touching a file
+or checking out an older revision of it will not cause a rebuild unless the
+contents actually differ.
+
 Packages are all built to the _obj directory in the root, and commands are 
 built to the bin directory in the root. If -i is on, they will be copied to 
 $GOROOT/pkg/$GOOS_$GOOARCH and $GOROOT/bin.
@@ -98,6 +105,26 @@ gcflags=<flag1> <flag2>...
   Include these flags on the compile line.
 proto=<plugin>
   Set the plugin for protobuf source generation.
+mirror=<dir>
+  In the workspace root, a local directory of repositories and tarballs,
+  laid out by import path, that -g and -G fetch goinstallable packages
+  from instead of the network. $GB_MIRROR overrides it. A package that
+  is not in the mirror is an error, unless it is already in GOPATH and
+  -G was not given.
+
+
+gb.remotes
+
+Besides the hosts go get knows about, an import path is goinstallable if
+it matches a line of the gb.remotes file in the workspace root. Each line
+has a regular expression for import paths, a version control system (git,
+hg, bzr or svn) and the URL to clone from, in which $1 or ${name} stand
+for the expression's groups:
+
+^(git\.example\.com/[a-z0-9_.\-]+)(/.*)?$ git ssh://git@git.example.com/$1.git
+
+The first group, or the one named "root", is the import path of the
+repository, which -g clones into GOPATH/src/<root>, and -G updates.
 
 
 Protobufs
@@ -132,6 +159,15 @@ or $GOARCH appears in the file name in the form of *_VALUE*.go, that file
 will only be included if it matches $GOOS or $GOARCH. The flag *_unix*.go 
 will match any of the unix-based $GOOS options.
 
+Source files may also carry build constraints: lines of the form
+"// +build linux,386 darwin,!cgo" before the package clause and followed by
+a blank line. The options on a line separated by spaces are OR'd, the terms
+separated by commas are AND'd, a leading ! negates a term, and all +build
+lines in a file must be satisfied. $GOOS, $GOARCH, unix, posix, bsd, gc,
+go1, cgo (when gcc is available) and any tags given with --tags are
+satisfied. Files that don't satisfy their constraints are listed as dead
+source by gb -L.
+
 Quickly check the build status of any target with gb -s. It will print out 
 a list of targets, and will tell you if they are up to date or installed 
 (if a target is installed, it is also up to date).
@@ -148,6 +184,16 @@ same time, you can run gb -R to build dependencies in $GOROOT.
 gb passes any command line arguments that begin with "-test." to testing
 binaries, when you run gb -t.
 
+Along with Test and Benchmark functions, gb -t runs the Example functions
+in test source that end with an "// Output:" comment, and checks that
+they print what the comment says.
+
+Test source does not have to be in the target's own package. A black-box
+"foo_test" package can import the target by its usual import path, and
+will get the target compiled together with its own package's test source.
+Test-only helper packages can be imported by name. gb reports an error if
+the name of one of these packages would hide a real one.
+
 
 Options:
  -i		Install build pkgs and cmds to $GOROOT/pkg/$GOOS_$GOARCH and
@@ -168,7 +214,13 @@ Options:
         repository.
 
  -p		Attempt to build a package immediately once its dependencies are
-		met and a processor is free.
+		met and a processor is free. Targets that depend on one that
+		fails to build are not attempted. With -t, the tests of several
+		targets are run at once, and the output of each target's tests
+		is printed in one piece once they finish.
+
+ -j N		The same as "-p", but build (or test) at most N targets at once. By
+		default "-p" builds as many targets at once as there are CPUs.
 
  -s		List all targets that are relevant to the current build plan. If
 		no directories are listed on the command line, all targets found
@@ -179,7 +231,9 @@ Options:
  -S		Same as "-s", except import dependencies are also printed.
 
  -t		Run all tests contained in *_test.go source for the relevant
-		targets. Behaves similarly to "make test". All additional
+		targets. Behaves similarly to "make test". Every target is
+		tested even if some fail, and the result of each is listed at
+		the end. All additional
 		command line arguments beginning with "-test." are passed to the
 		test binary (see http://golang.org/cmd/gotest for details).
 
@@ -213,10 +267,166 @@ Options:
  --gofmt
  		Run gofmt on all source for relevant targets.
 
+ --check-deps
+ 		Instead of building, list the imports of each listed target that
+ 		cannot be resolved, under the source file (test source included)
+ 		that has them, along with why: not in the workspace and not in
+ 		GOROOT/pkg, and either not goinstallable or goinstallable without
+ 		-g. Then list the workspace packages that no listed target
+ 		imports, directly or through other targets. gb fails if any
+ 		import is unresolved.
+
+ --vendor
+ 		Copy the source of every goinstallable package imported by the
+ 		listed targets, or by the targets they depend on, from GOPATH
+ 		into vendor/<import path> in the workspace, along with the
+ 		goinstallable packages those import. With -g, packages that are
+ 		not in GOPATH are fetched first, and with -G, all of them are
+ 		updated first. Packages already under vendor are copied again.
+ 		Packages under vendor are built as part of the workspace, with
+ 		the import path they have within vendor, so that the build no
+ 		longer depends on what is in GOPATH.
+
+ --locked
+ 		After building with -g or -G, gb writes gb.lock in the workspace
+ 		root, listing each goinstallable package the targets import with
+ 		the version control system and revision of its checkout in
+ 		GOPATH, or removes it once none are imported. With --locked,
+ 		before building, each of those checkouts is updated to the
+ 		revision in gb.lock, fetching into the existing clone if the
+ 		revision is not there yet, and the package is installed again.
+ 		Packages not yet in GOPATH are fetched first.
+ 		Commit gb.lock so that everyone builds against the same
+ 		revisions. Cannot be used with -G.
+
  --make-a-mess
  		Do not clean up intermediate files, such as .6/.8, the _cgo
  		directory and the _test directory.
 
+ --platforms=<GOOS>/<GOARCH>,...
+ 		Run the whole scan and build once for each of the listed
+ 		platforms, eg "--platforms=linux/amd64,linux/386,linux/arm".
+ 		Each platform gets its own _obj/$GOOS_$GOARCH and
+ 		_bin/$GOOS_$GOARCH directories, and cross-compiled cmds are
+ 		installed to a $GOOS_$GOARCH subdirectory of the usual place.
+ 		Tests are only run for the native platform. A summary of each
+ 		platform's results is printed at the end.
+
+ --rescan
+ 		gb remembers what it found in each source file in gb.scancache,
+ 		in the workspace root, and does not parse a file again until its
+ 		size or modification time changes. This option ignores the
+ 		cache, parses everything, and replaces the cache with the result.
+ 		Deleting gb.scancache has the same effect.
+
+ --tags=<tag1>,<tag2>...
+ 		Treat these tags as satisfied when evaluating // +build
+ 		constraints.
+
+ --watch
+ 		After building, keep running and poll the directories of the
+ 		known targets for changes. When a target's source changes, only
+ 		that target is scanned again, and it and the listed targets that
+ 		depend on it are rebuilt - and retested, if -t is also used.
+ 		Directories that did not contain a target when gb started are
+ 		not watched.
+
+ --log=FILE
+ 		Record every external command gb runs (compiling, packing,
+ 		linking, cgo, gcc, protoc, goyacc, ...) in FILE, one JSON object
+ 		per line, giving the step, target, working directory, arguments,
+ 		exit status, anything written to stderr, the start time and how
+ 		long it took in seconds. The slowest targets are listed at the
+ 		end of the run.
+
+ --json
+ 		Scan, like "-s", but print a single JSON document describing
+ 		every relevant target: its directory, package name, kind,
+ 		dependencies, source files (including those that will not be
+ 		built), result and install paths, and whether it needs to be
+ 		built or installed. Nothing else is written to stdout.
+
+ --graph
+ 		Print the import graph of the relevant targets, and of everything
+ 		they depend on, in Graphviz's DOT language (eg "gb --graph | dot
+ 		-Tpng > deps.png"). Workspace targets are boxes, GOROOT and
+ 		GOPATH packages are grey and blue ellipses, packages goinstall
+ 		could fetch are dashed ellipses, and imports that cannot be
+ 		resolved are red. Imports that only come from test source are
+ 		drawn as dashed edges.
+
+ --cover[=<file>]
+ 		With -t, instrument the build source of each target being tested,
+ 		print the fraction of its statements that its tests run, and
+ 		write the counts for all of them to a single profile, which can
+ 		be read with "go tool cover". The profile is written to <file>,
+ 		or to cover.out in the workspace root if no file is given.
+ 		Targets tested with make (including cgo targets) are not covered.
+
+ --bench=<regex>
+ 		With -t, also run the benchmarks whose names match <regex>, as
+ 		with -test.bench. Benchmarks are always run, even when the tests
+ 		of a target would otherwise be cached, and targets are tested one
+ 		at a time, even with -p or -j.
+
+ --bench-save=<name>
+ 		Write the ns/op of every benchmark run to gb.bench.<name> in the
+ 		workspace root. If a benchmark runs more than once (with
+ 		-test.count), the mean is saved. Implies --bench=. if no
+ 		--bench is given.
+
+ --bench-compare=<name>
+ 		After the benchmarks run, print a table comparing them with the
+ 		ones saved in gb.bench.<name>, with the change in each, and mark
+ 		those that got slower by more than the threshold as
+ 		regressions. Implies --bench=. if no --bench is given.
+
+ --bench-threshold=<percent>
+ 		How much slower than its saved result a benchmark must be to be
+ 		called a regression by --bench-compare. Defaults to 10.
+
+ --test-timeout=<duration>
+ 		With -t, stop any test binary that has been running for longer
+ 		than <duration>, such as 30s or 10m. It is first sent SIGQUIT,
+ 		so that it prints the stack of every goroutine before exiting,
+ 		and is killed if it is still running a few seconds later. The
+ 		stacks are printed with the rest of the test output, the target
+ 		is reported as failed, and the other targets are still tested.
+
+ --test-shuffle[=<seed>]
+ 		With -t, run the tests of each package in an order chosen by
+ 		<seed>, or by a seed picked at random if none is given. The
+ 		seed is printed by gb and by each test binary, and gb suggests
+ 		it again when a target's tests fail; giving it back with
+ 		--test-shuffle=<seed> runs the tests in exactly the same order,
+ 		as long as none have been added or removed.
+
+ --test-compile-only
+ 		With -t, link each target's test binary but do not run it. The
+ 		binary is left in the target's _test directory and copied to
+ 		_bin/tests/<target>.test, and _bin/tests/manifest.json lists
+ 		each target with its binary, the directory the binary must be
+ 		run in and the arguments given with --testargs, so that the
+ 		tests can be run later, or on another machine. Targets whose
+ 		tests are run with make are listed as skipped.
+
+ --retest
+ 		When a target's tests pass, gb remembers what they printed, in
+ 		_obj/gb.testcache. The next time, if nothing the tests depend on
+ 		has changed - the target and its test source, the targets and
+ 		packages the tests import, the testdata directory, the arguments
+ 		given with -test. or --testargs, and the environment - the tests
+ 		are not run again, and their output is printed with "(cached)".
+ 		This option runs the tests anyway. Tests run with --cover or
+ 		--junit are never cached.
+
+ --junit=<dir>
+ 		With -t, run each test binary with -test.v and write the results
+ 		it reports to <dir>/<target>.xml in JUnit's XML format, with one
+ 		testcase for each test, example and benchmark, including its
+ 		duration and, if it failed, what it logged. The test output is
+ 		still printed as usual.
+
  --testargs
  		All command line arguments that follow --testargs will be
  		passed on to the test binaries, and otherwise ignored.
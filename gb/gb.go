@@ -23,7 +23,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // command line flags
@@ -50,7 +55,13 @@ var Install, //-i
 	DoCmds, //-C
 	Distribution, //--dist (deprecated)
 	Workspace, //--workspace
-	MakeAMess bool //--make-a-mess
+	MakeAMess, //--make-a-mess
+	JSONOutput, //--json
+	GraphOutput, //--graph
+	Watch bool //--watch
+
+// set when stdout is reserved for --json or --graph output
+var MachineReadable bool
 
 var IncludeDir string
 var GCArgs []string
@@ -67,9 +78,37 @@ var HardArgs, BuildArgs int
 
 var TestArgs []string
 
+// set by --test-timeout; 0 means test binaries may run forever
+var TestTimeout time.Duration
+
 var BrokenMsg []string
 var ReturnFailCode bool
 
+// the number of targets to build at once with -p
+var Jobs = runtime.NumCPU()
+
+// guards the counters, BrokenMsg and ReturnFailCode, which are updated
+// from build and test workers
+var statusLock sync.Mutex
+
+func Tally(counter *int) {
+	statusLock.Lock()
+	*counter++
+	statusLock.Unlock()
+}
+
+func ReportBroken(msg string) {
+	statusLock.Lock()
+	BrokenMsg = append(BrokenMsg, msg)
+	statusLock.Unlock()
+}
+
+func ReportFailure() {
+	statusLock.Lock()
+	ReturnFailCode = true
+	statusLock.Unlock()
+}
+
 var RunningInGOROOT bool
 var RunningInGOPATH string
 
@@ -164,6 +203,11 @@ func ScanDirectory(sdd SDData) (err2 error) {
 		sdd.base = "."
 	}
 
+	if sdd.dir == VendorDir {
+		// vendored packages keep their own import paths
+		sdd.base = "."
+	}
+
 	cfg := ReadConfig(sdd.dir)
 
 	if target, set := cfg.Target(); set {
@@ -208,7 +252,7 @@ func ScanDirectory(sdd SDData) (err2 error) {
 				sdd.base = tbase
 			}
 		}
-	} else {
+	} else if !MachineReadable {
 		fmt.Println(sdd.dir, "ignored")
 	}
 
@@ -255,8 +299,9 @@ func IsListed(name string) bool {
 	return false
 }
 
-func TryScan() {
+func TryScan() (err error) {
 	if Scan {
+		var scanPkgs []*Package
 		for _, pkg := range Packages {
 			if pkg.IsInGOROOT && !RunningInGOROOT {
 				continue
@@ -265,11 +310,18 @@ func TryScan() {
 				continue
 			}
 			if IsListed(pkg.Dir) {
-				pkg.PrintScan()
+				if JSONOutput {
+					scanPkgs = append(scanPkgs, pkg)
+				} else {
+					pkg.PrintScan()
+				}
 			}
 		}
-		return
+		if JSONOutput {
+			err = WriteScanJSON(scanPkgs)
+		}
 	}
+	return
 }
 
 func TryGoFMT() (err error) {
@@ -343,52 +395,94 @@ func TryClean() {
 }
 
 func TryBuild() {
-
 	if Build {
-		if Concurrent {
-			for _, pkg := range ListedPkgs {
-				pkg.CheckStatus()
-				go pkg.Build()
-			}
-		}
-		for _, pkg := range ListedPkgs {
+		BuildTargets(ListedPkgs)
+	}
+}
+
+func BuildTargets(pkgs []*Package) {
+	if Concurrent {
+		for _, pkg := range pkgs {
 			pkg.CheckStatus()
-			err := pkg.Build()
-			if err != nil {
-				return
-			}
+		}
+		NewBuildScheduler(Jobs).Build(pkgs)
+		return
+	}
+	for _, pkg := range pkgs {
+		pkg.CheckStatus()
+		err := pkg.Build()
+		if err != nil {
+			return
 		}
 	}
 }
 
 func TryTest() (err error) {
 	if Test {
-		for _, pkg := range ListedPkgs {
-			if len(pkg.TestSources) != 0 {
-				err = pkg.Test()
-				if err != nil {
-					return
-				}
+		err = TestTargets(ListedPkgs)
+	}
+	return
+}
+
+func TestTargets(pkgs []*Package) (err error) {
+	if Cover {
+		defer func() {
+			if werr := WriteCoverProfile(); werr != nil && err == nil {
+				err = werr
 			}
+		}()
+	}
+	if Benchmarking() {
+		defer func() {
+			if berr := FinishBenchmarks(); berr != nil && err == nil {
+				err = berr
+			}
+		}()
+	}
+	if TestCompileOnly {
+		defer func() {
+			if werr := WriteTestManifest(); werr != nil && err == nil {
+				err = werr
+			}
+		}()
+	}
+	if TestShuffle {
+		fmt.Printf("Shuffling tests with seed %d\n", TestShuffleSeed)
+	}
+	var tested []*Package
+	for _, pkg := range pkgs {
+		if len(pkg.TestSources) != 0 {
+			tested = append(tested, pkg)
 		}
 	}
+
+	jobs := 1
+	// benchmarks are timed, so they get the machine to themselves
+	if Concurrent && !Benchmarking() {
+		jobs = Jobs
+	}
+	err = PrintTestResults(RunTests(tested, jobs))
 	return
 }
 
 func TryInstall() {
 	if Install {
-		brokenMsg := []string{}
-		for _, pkg := range ListedPkgs {
-			err := pkg.Install()
-			if err != nil {
-				brokenMsg = append(brokenMsg, fmt.Sprintf("(in %s) could not install \"%s\"", pkg.Dir, pkg.Target))
-			}
+		InstallTargets(ListedPkgs)
+	}
+}
+
+func InstallTargets(pkgs []*Package) {
+	brokenMsg := []string{}
+	for _, pkg := range pkgs {
+		err := pkg.Install()
+		if err != nil {
+			brokenMsg = append(brokenMsg, fmt.Sprintf("(in %s) could not install \"%s\"", pkg.Dir, pkg.Target))
 		}
+	}
 
-		if len(brokenMsg) != 0 {
-			for _, msg := range brokenMsg {
-				fmt.Printf("%s\n", msg)
-			}
+	if len(brokenMsg) != 0 {
+		for _, msg := range brokenMsg {
+			fmt.Printf("%s\n", msg)
 		}
 	}
 }
@@ -415,19 +509,24 @@ func RunGB() (err error) {
 		return
 	}
 	if BuildGOROOT {
-		fmt.Printf("Scanning %s...", filepath.Join("GOROOT", "src"))
+		progress := func(format string, args ...interface{}) {
+			if !MachineReadable {
+				fmt.Printf(format, args...)
+			}
+		}
+		progress("Scanning %s...", filepath.Join("GOROOT", "src"))
 		gorootsdd := SDData{
 			dir: filepath.Join(GOROOT, "src"),
 		}
 		ScanDirectory(gorootsdd)
-		fmt.Printf("done\n")
+		progress("done\n")
 		for _, gp := range GOPATHS {
-			fmt.Printf("Scanning %s...", filepath.Join(gp, "src"))
+			progress("Scanning %s...", filepath.Join(gp, "src"))
 			gopathsdd := SDData{
 				dir: filepath.Join(gp, "src"),
 			}
 			ScanDirectory(gopathsdd)
-			fmt.Printf("done\n")
+			progress("done\n")
 		}
 	}
 
@@ -474,6 +573,14 @@ func RunGB() (err error) {
 		return
 	}
 
+	if err = ReadManifest(); err != nil {
+		return
+	}
+
+	if err = TryLocked(); err != nil {
+		return
+	}
+
 	for _, pkg := range Packages {
 		pkg.Stat()
 	}
@@ -482,23 +589,29 @@ func RunGB() (err error) {
 		pkg.ResolveDeps()
 	}
 
+	var allPkgs []*Package
 	for _, pkg := range Packages {
-		cycle := pkg.DetectCycles()
-		if cycle != nil {
-			var targets []string
-			for _, cp := range cycle {
-				targets = append(targets, cp.Target)
-			}
-			err = errors.New(fmt.Sprintf("Cycle detected: %v", targets))
-			return
-		}
+		allPkgs = append(allPkgs, pkg)
+	}
+	if err = CycleError(FindCycles(allPkgs)); err != nil {
+		return
 	}
 
 	for _, pkg := range Packages {
 		pkg.CheckStatus()
 	}
 
-	TryScan()
+	if err = TryScan(); err != nil {
+		return
+	}
+
+	if err = TryGraph(); err != nil {
+		return
+	}
+
+	if err = TryCheckDeps(); err != nil {
+		return
+	}
 
 	if err = TryGoFix(); err != nil {
 		return
@@ -516,16 +629,35 @@ func RunGB() (err error) {
 		return
 	}
 
+	if err = TryVendor(); err != nil {
+		return
+	}
+
 	TryClean()
 
 	TryBuild()
 
+	if err = TryLock(); err != nil {
+		return
+	}
+
 	if err = TryTest(); err != nil {
+		PrintSummary()
 		return
 	}
 
 	TryInstall()
 
+	PrintSummary()
+
+	if Watch {
+		err = WatchForChanges()
+	}
+
+	return
+}
+
+func PrintSummary() {
 	if Build {
 		if PackagesBuilt > 1 {
 			fmt.Printf("Built %d targets\n", PackagesBuilt)
@@ -546,6 +678,9 @@ func RunGB() (err error) {
 			fmt.Println("1 broken target")
 		}
 		if len(BrokenMsg) != 0 {
+			if Concurrent {
+				sort.Strings(BrokenMsg)
+			}
 			for _, msg := range BrokenMsg {
 				fmt.Printf("%s\n", msg)
 			}
@@ -556,12 +691,25 @@ func RunGB() (err error) {
 			fmt.Printf("No mess to clean\n")
 		}
 	}
-
-	return
 }
 
 func CheckFlags() bool {
+	// arguments that are values for a preceding flag, rather than directories
+	consumed := make(map[int]bool)
+	defer func() {
+		var args []string
+		for i, arg := range os.Args {
+			if !consumed[i] {
+				args = append(args, arg)
+			}
+		}
+		os.Args = args
+	}()
+
 	for i, arg := range os.Args[1:] {
+		if consumed[i+1] {
+			continue
+		}
 		if arg == "--testargs" {
 			TestArgs = append(TestArgs, os.Args[i+2:]...)
 			os.Args = os.Args[:i+2]
@@ -576,7 +724,11 @@ func CheckFlags() bool {
 			continue
 		}
 		if strings.HasPrefix(arg, "--") {
-			switch arg {
+			name, value := arg, ""
+			if eq := strings.Index(arg, "="); eq != -1 {
+				name, value = arg[:eq], arg[eq+1:]
+			}
+			switch name {
 			case "--gofmt":
 				GoFMT = true
 				HardArgs++
@@ -591,12 +743,111 @@ func CheckFlags() bool {
 			case "--workspace":
 				Workspace = true
 				HardArgs++
+			case "--check-deps":
+				DepCheck = true
+				HardArgs++
+			case "--vendor":
+				Vendor = true
+				HardArgs++
+			case "--locked":
+				Locked = true
 			case "--make-a-mess":
 				MakeAMess = true
+			case "--log":
+				if value == "" {
+					ErrLog.Printf("--log requires a file name, as in --log=build.log")
+					return false
+				}
+				BuildLogFile = value
+			case "--platforms":
+				platforms, err := ParsePlatforms(value)
+				if err != nil {
+					ErrLog.Printf("%v", err)
+					return false
+				}
+				Platforms = platforms
+			case "--cover":
+				Cover = true
+				CoverProfileFile = value
+			case "--junit":
+				if value == "" {
+					ErrLog.Printf("--junit requires a directory, as in --junit=test-results")
+					return false
+				}
+				JUnitDir = value
+			case "--bench":
+				if value == "" {
+					ErrLog.Printf("--bench requires a pattern, as in --bench=. for every benchmark")
+					return false
+				}
+				BenchPattern = value
+			case "--bench-save":
+				if value == "" {
+					ErrLog.Printf("--bench-save requires a name, as in --bench-save=before")
+					return false
+				}
+				BenchSave = value
+			case "--bench-compare":
+				if value == "" {
+					ErrLog.Printf("--bench-compare requires a name, as in --bench-compare=before")
+					return false
+				}
+				BenchCompare = value
+			case "--bench-threshold":
+				threshold, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+				if err != nil || threshold < 0 {
+					ErrLog.Printf("--bench-threshold requires a percentage, as in --bench-threshold=5")
+					return false
+				}
+				BenchThreshold = threshold
+			case "--test-timeout":
+				timeout, err := time.ParseDuration(value)
+				if err != nil || timeout <= 0 {
+					ErrLog.Printf("--test-timeout requires a duration, as in --test-timeout=10m")
+					return false
+				}
+				TestTimeout = timeout
+			case "--test-shuffle":
+				if err := PickShuffleSeed(value); err != nil {
+					ErrLog.Printf("--test-shuffle takes an integer seed, as in --test-shuffle=42")
+					return false
+				}
+			case "--test-compile-only":
+				TestCompileOnly = true
+			case "--retest":
+				ForceRetest = true
+			case "--rescan":
+				ForceRescan = true
+			case "--tags":
+				AddBuildTags(value)
+			case "--watch":
+				Watch = true
+			case "--json":
+				JSONOutput = true
+				MachineReadable = true
+				Scan = true
+			case "--graph":
+				GraphOutput = true
+				MachineReadable = true
+				HardArgs++
 			default:
 				Usage()
 				return false
 			}
+		} else if strings.HasPrefix(arg, "-j") {
+			// -jN or -j N
+			jstr := arg[2:]
+			if jstr == "" && i+2 < len(os.Args) {
+				jstr = os.Args[i+2]
+				consumed[i+2] = true
+			}
+			jobs, err := strconv.Atoi(jstr)
+			if err != nil || jobs < 1 {
+				ErrLog.Printf("-j requires a positive number of jobs")
+				return false
+			}
+			Jobs = jobs
+			Concurrent = true
 		} else if strings.HasPrefix(arg, "-") {
 			for _, flag := range arg[1:] {
 				switch flag {
@@ -653,6 +904,58 @@ func CheckFlags() bool {
 		}
 	}
 
+	if Cover && !Test {
+		ErrLog.Printf("Must be in test mode (-t) to use --cover")
+		return false
+	}
+
+	if (BenchSave != "" || BenchCompare != "") && BenchPattern == "" {
+		BenchPattern = "."
+	}
+	if Benchmarking() {
+		if !Test {
+			ErrLog.Printf("Must be in test mode (-t) to use --bench")
+			return false
+		}
+		TestArgs = append(TestArgs, "-test.bench="+BenchPattern)
+	}
+
+	if JUnitDir != "" && !Test {
+		ErrLog.Printf("Must be in test mode (-t) to use --junit")
+		return false
+	}
+
+	if TestTimeout != 0 && !Test {
+		ErrLog.Printf("Must be in test mode (-t) to use --test-timeout")
+		return false
+	}
+
+	if Locked && GoInstallUpdate {
+		ErrLog.Printf("Cannot use -G with --locked, since gb.lock decides the revisions.\n")
+		return false
+	}
+
+	if TestShuffle && !Test {
+		ErrLog.Printf("Must be in test mode (-t) to use --test-shuffle")
+		return false
+	}
+
+	if TestCompileOnly {
+		if !Test {
+			ErrLog.Printf("Must be in test mode (-t) to use --test-compile-only")
+			return false
+		}
+		if Cover || JUnitDir != "" || Benchmarking() || TestTimeout != 0 {
+			ErrLog.Printf("Cannot use --cover, --junit, --bench or --test-timeout with --test-compile-only, since the tests are not run")
+			return false
+		}
+	}
+
+	if Watch && len(Platforms) != 0 {
+		ErrLog.Printf("Cannot use --watch with --platforms.\n")
+		return false
+	}
+
 	if HardArgs > 0 && BuildArgs > 0 {
 		ErrLog.Printf("Cannot have -- style arguments and build at the same time.\n")
 		return false
@@ -662,16 +965,22 @@ func CheckFlags() bool {
 }
 
 func main() {
-	if err := LoadCWD(); err != nil {
+	if !CheckFlags() {
+		return
+	}
+
+	if err := OpenBuildLog(); err != nil {
 		ErrLog.Printf("%v\n", err)
 		return
 	}
+	defer CloseBuildLog()
 
-	if !LoadEnvs() {
+	if err := LoadCWD(); err != nil {
+		ErrLog.Printf("%v\n", err)
 		return
 	}
 
-	if !CheckFlags() {
+	if !LoadEnvs() {
 		return
 	}
 
@@ -689,17 +998,30 @@ func main() {
 		GLArgs = append(GLArgs, []string{"-L", IncludeDir}...)
 	}
 
-	err = RunGB()
-	if err != nil {
-		ErrLog.Printf("%v\n", err)
-		ReturnFailCode = true
+	if len(Platforms) != 0 {
+		if RunPlatforms() {
+			ReturnFailCode = true
+		}
+	} else {
+		err = RunGB()
+		if err != nil {
+			ErrLog.Printf("%v\n", err)
+			ReturnFailCode = true
+		}
+	}
+
+	if err := SaveScanCache(); err != nil {
+		WarnLog.Printf("Could not save the scan cache: %v", err)
 	}
 
 	if len(BrokenMsg) > 0 {
 		ReturnFailCode = true
 	}
 
+	PrintSlowestTargets()
+
 	if ReturnFailCode {
+		CloseBuildLog()
 		os.Exit(1)
 	}
 }
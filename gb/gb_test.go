@@ -17,7 +17,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -99,3 +108,553 @@ func TestGetRelative(t *testing.T) {
 func BenchmarkX(b *testing.B) {
 	//do nothing
 }
+
+func TestFindCycles(t *testing.T) {
+	mk := func(target string) *Package {
+		return &Package{
+			Dir:     target,
+			Base:    target,
+			Target:  target,
+			SrcDeps: make(map[string][]string),
+		}
+	}
+	imports := func(from, to *Package, src string) {
+		from.DepPkgs = append(from.DepPkgs, to)
+		from.SrcDeps[src] = append(from.SrcDeps[src], "\""+to.Target+"\"")
+	}
+
+	a, b, c, d, e, f := mk("a"), mk("b"), mk("c"), mk("d"), mk("e"), mk("f")
+	imports(a, b, "a1.go")
+	imports(b, c, "b.go")
+	imports(c, a, "c.go")
+	imports(c, d, "c.go")
+	imports(d, e, "d.go")
+	imports(e, d, "e.go")
+	imports(f, a, "f.go")
+
+	cycles := FindCycles([]*Package{f, e, d, c, b, a})
+	if len(cycles) != 2 {
+		t.Fatalf("found %d cycles, was expecting 2", len(cycles))
+	}
+
+	truth := []string{
+		"Cycle detected among [a b c]\n (in a) a1.go imports \"b\"\n (in b) b.go imports \"c\"\n (in c) c.go imports \"a\"",
+		"Cycle detected among [d e]\n (in d) d.go imports \"e\"\n (in e) e.go imports \"d\"",
+	}
+	for i, cycle := range cycles {
+		if cycle.String() != truth[i] {
+			t.Error(fmt.Sprintf("cycle %d was\n%s\nwas expecting\n%s", i, cycle.String(), truth[i]))
+		}
+	}
+
+	if cycles := FindCycles([]*Package{d}); len(cycles) != 1 {
+		t.Error(fmt.Sprintf("found %d cycles from d, was expecting 1", len(cycles)))
+	}
+}
+
+func TestBuildConstraints(t *testing.T) {
+	oldGOOS, oldGOARCH, oldBuildTags := GOOS, GOARCH, BuildTags
+	GOOS, GOARCH = "linux", "amd64"
+	BuildTags = map[string]bool{"custom": true}
+	defer func() {
+		GOOS, GOARCH, BuildTags = oldGOOS, oldGOARCH, oldBuildTags
+	}()
+
+	lineTests := []struct {
+		line  string
+		truth bool
+	}{
+		{`linux`, true},
+		{`darwin`, false},
+		{`!darwin`, true},
+		{`linux,386`, false},
+		{`linux,amd64`, true},
+		{`darwin linux,!386`, true},
+		{`darwin,amd64 windows`, false},
+		{`custom`, true},
+		{`!custom`, false},
+		{`unix,!bsd`, true},
+		{`!!linux`, false},
+		{``, false},
+	}
+	for _, lt := range lineTests {
+		if result := MatchBuildLine(lt.line); result != lt.truth {
+			t.Error(fmt.Sprintf("MatchBuildLine(%q) -> %v, was expecting %v", lt.line, result, lt.truth))
+		}
+	}
+
+	srcTests := []struct {
+		src   string
+		truth []string
+	}{
+		{"// +build linux\n\npackage x\n", []string{"linux"}},
+		{"// +build linux\n// +build !386\n\n// Package x.\npackage x\n", []string{"linux", "!386"}},
+		{"// +build linux\npackage x\n", nil},
+		{"package x\n\n// +build linux\n", nil},
+	}
+	for _, st := range srcTests {
+		file, err := parser.ParseFile(token.NewFileSet(), "x.go", st.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := BuildConstraints(file)
+		if fmt.Sprint(result) != fmt.Sprint(st.truth) {
+			t.Error(fmt.Sprintf("BuildConstraints(%q) -> %q, was expecting %q", st.src, result, st.truth))
+		}
+	}
+}
+
+func TestInstrumentFile(t *testing.T) {
+	src := `package x
+
+func f(x int) int {
+	if x < 0 {
+		return -x
+	}
+	switch x {
+	case 1:
+		x++
+	}
+	return x
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "x.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []CoverBlock
+	InstrumentFile(fset, file, "x/x.go", &blocks)
+
+	truth := []CoverBlock{
+		{"x/x.go", 4, 2, 6, 3, 1},
+		{"x/x.go", 7, 2, 10, 3, 1},
+		{"x/x.go", 11, 2, 11, 10, 1},
+		{"x/x.go", 5, 3, 5, 12, 1},
+		{"x/x.go", 9, 3, 9, 6, 1},
+	}
+	if fmt.Sprint(blocks) != fmt.Sprint(truth) {
+		t.Error(fmt.Sprintf("InstrumentFile -> %v, was expecting %v", blocks, truth))
+	}
+}
+
+func TestExampleOutputs(t *testing.T) {
+	src := `package x
+
+func ExampleA() {
+	println("a")
+	// Output: a
+}
+
+func ExampleB() {
+	// not the last comment
+	println("b")
+	// output:
+	// b
+	// c
+}
+
+func ExampleC() {
+	println("c")
+}
+
+func ExampleD(x int) {
+	// Output: d
+}
+`
+	file, err := parser.ParseFile(token.NewFileSet(), "x_test.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := ExampleOutputs(file)
+	truth := map[string]string{
+		"ExampleA": "a",
+		"ExampleB": "b\nc",
+	}
+	if fmt.Sprint(outputs) != fmt.Sprint(truth) {
+		t.Error(fmt.Sprintf("ExampleOutputs -> %q, was expecting %q", outputs, truth))
+	}
+}
+
+func TestExternalTestPackages(t *testing.T) {
+	pkg := &Package{
+		Dir:    "foo",
+		Name:   "foo",
+		Target: "foo",
+		TestSrc: map[string][]string{
+			"foo":      {"foo_test.go"},
+			"foo_test": {"x_test.go"},
+			"helper":   {"helper_test.go"},
+			"zhelper":  {"zhelper_test.go"},
+		},
+		TestPkgDeps: map[string][]string{
+			"foo":      {`"testing"`},
+			"foo_test": {`"foo"`, `"zhelper"`, `"testing"`},
+			"zhelper":  {`"helper"`},
+		},
+	}
+	names, err := pkg.ExternalTestPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	truth := []string{"helper", "zhelper", "foo_test"}
+	if fmt.Sprint(names) != fmt.Sprint(truth) {
+		t.Error(fmt.Sprintf("ExternalTestPackages -> %v, was expecting %v", names, truth))
+	}
+
+	pkg.TestPkgDeps["helper"] = []string{`"foo_test"`}
+	if _, err = pkg.ExternalTestPackages(); err == nil {
+		t.Error("ExternalTestPackages did not report test packages importing each other")
+	}
+}
+
+func TestParseTestOutput(t *testing.T) {
+	output := `=== RUN   foo.TestA
+--- PASS: foo.TestA (0.01s)
+=== RUN   foo.TestB
+--- FAIL: foo.TestB (0.20s)
+    foo_test.go:12: wrong answer
+    foo_test.go:13: still wrong
+=== RUN   foo.TestC
+--- SKIP: foo.TestC (0.00 seconds)
+    foo_test.go:20: not today
+=== RUN   foo.ExampleD
+--- FAIL: foo.ExampleD (0.00s)
+got:
+1
+want:
+2
+foo.BenchmarkE	 1000000	      2000 ns/op
+=== RUN   foo.TestF
+panic: oops
+`
+	cases, unfinished := ParseTestOutput(output)
+	var results []string
+	for _, c := range cases {
+		result := c.Name + " " + c.Time
+		if c.Failure != nil {
+			result += fmt.Sprintf(" failed %q %q", c.Failure.Message, c.Failure.Text)
+		}
+		if c.Skipped != nil {
+			result += fmt.Sprintf(" skipped %q", c.Skipped.Message)
+		}
+		results = append(results, result)
+	}
+	truth := []string{
+		`foo.TestA 0.010`,
+		`foo.TestB 0.200 failed "foo_test.go:12: wrong answer" "    foo_test.go:12: wrong answer\n    foo_test.go:13: still wrong"`,
+		`foo.TestC 0.000 skipped "foo_test.go:20: not today"`,
+		`foo.ExampleD 0.000 failed "got:" "got:\n1\nwant:\n2"`,
+		`foo.BenchmarkE 2.000`,
+	}
+	if fmt.Sprintf("%q", results) != fmt.Sprintf("%q", truth) {
+		t.Error(fmt.Sprintf("ParseTestOutput -> %q, was expecting %q", results, truth))
+	}
+	if fmt.Sprint(unfinished) != "[foo.TestF]" {
+		t.Error(fmt.Sprintf("ParseTestOutput found unfinished %v, was expecting [foo.TestF]", unfinished))
+	}
+}
+
+func TestCompareBenchmarks(t *testing.T) {
+	saved := BenchResults{
+		"a": {"a.BenchmarkX": 100, "a.BenchmarkY": 200, "a.BenchmarkGone": 5},
+		"b": {"b.BenchmarkZ": 10},
+	}
+	current := BenchResults{
+		"a": {"a.BenchmarkX": 150, "a.BenchmarkY": 190, "a.BenchmarkNew": 7},
+	}
+	lines, regressions := CompareBenchmarks(saved, current, 10)
+	truth := []string{
+		` target  benchmark        old ns/op  new ns/op  delta`,
+		` "a"     a.BenchmarkGone  5          -`,
+		` "a"     a.BenchmarkNew   -          7`,
+		` "a"     a.BenchmarkX     100        150        +50.00% REGRESSION`,
+		` "a"     a.BenchmarkY     200        190        -5.00%`,
+	}
+	if fmt.Sprintf("%q", lines) != fmt.Sprintf("%q", truth) {
+		t.Error(fmt.Sprintf("CompareBenchmarks -> %q, was expecting %q", lines, truth))
+	}
+	if regressions != 1 {
+		t.Error(fmt.Sprintf("CompareBenchmarks found %d regressions, was expecting 1", regressions))
+	}
+}
+
+func TestShuffleTests(t *testing.T) {
+	names := []string{"TestA", "TestB", "TestC", "TestD", "TestE", "TestF"}
+	reversed := []string{"TestF", "TestE", "TestD", "TestC", "TestB", "TestA"}
+
+	first := ShuffleTests(names, 42)
+	if again := ShuffleTests(reversed, 42); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Error(fmt.Sprintf("ShuffleTests with the same seed -> %v and %v", first, again))
+	}
+	sorted := append([]string{}, first...)
+	sort.Strings(sorted)
+	if fmt.Sprint(sorted) != fmt.Sprint(names) {
+		t.Error(fmt.Sprintf("ShuffleTests -> %v, which is not a reordering of %v", first, names))
+	}
+	if fmt.Sprint(names) != "[TestA TestB TestC TestD TestE TestF]" {
+		t.Error(fmt.Sprintf("ShuffleTests changed its argument to %v", names))
+	}
+
+	differs := false
+	for seed := int64(0); seed < 10; seed++ {
+		if fmt.Sprint(ShuffleTests(names, seed)) != fmt.Sprint(first) {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Error("ShuffleTests gave the same order for every seed")
+	}
+}
+
+func TestTarballPrefix(t *testing.T) {
+	tests := []struct {
+		names  []string
+		prefix string
+	}{
+		{[]string{"bar-1.0/", "bar-1.0/bar.go", "bar-1.0/baz/baz.go"}, "bar-1.0"},
+		{[]string{"./bar-1.0/bar.go", "./bar-1.0/README"}, "bar-1.0"},
+		{[]string{"bar.go", "baz/baz.go"}, ""},
+		{[]string{"bar/bar.go", "baz/baz.go"}, ""},
+		{[]string{"bar.go"}, ""},
+	}
+	for _, test := range tests {
+		if prefix := tarballPrefix(test.names); prefix != test.prefix {
+			t.Error(fmt.Sprintf("tarballPrefix(%q) -> %q, was expecting %q", test.names, prefix, test.prefix))
+		}
+	}
+}
+
+func TestRemotes(t *testing.T) {
+	remotes, err := ParseRemotes(strings.NewReader(`
+# our code host
+^(git\.example\.com/[a-z0-9_.\-]+)(/.*)?$ git ssh://git@git.example.com/$1.git
+^hg\.example\.com/(?P<root>(?P<repo>[a-z]+))(/.*)?$ hg https://hg.example.com/r/${repo}
+`), "gb.remotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target, root, url string
+	}{
+		{"git.example.com/tools/sub/pkg", "git.example.com/tools", "ssh://git@git.example.com/git.example.com/tools.git"},
+		{"hg.example.com/lib", "lib", "https://hg.example.com/r/lib"},
+		{"github.com/foo/bar", "", ""},
+	}
+	for _, test := range tests {
+		var root, url string
+		for _, remote := range remotes {
+			var ok bool
+			if root, url, ok = remote.Match(test.target); ok {
+				break
+			}
+		}
+		if root != test.root || url != test.url {
+			t.Error(fmt.Sprintf("%s matched %q %q, was expecting %q %q", test.target, root, url, test.root, test.url))
+		}
+	}
+
+	if _, err := ParseRemotes(strings.NewReader("^x$ cvs http://x\n"), "gb.remotes"); err == nil {
+		t.Error("ParseRemotes accepted an unknown version control system")
+	}
+}
+
+func TestGoInstallableVCSSuffix(t *testing.T) {
+	for target, truth := range map[string]bool{
+		"example.com/repo.git":           true,
+		"example.com:8080/a/repo.hg/sub": true,
+		"example.com/repo":               false,
+		"repo.git":                       false,
+	} {
+		if IsGoInstallable(target) != truth {
+			t.Error(fmt.Sprintf("IsGoInstallable(%q) -> %v, was expecting %v", target, !truth, truth))
+		}
+	}
+}
+
+func TestUnusedPackages(t *testing.T) {
+	pkgs := make(map[string]*Package)
+	for _, target := range []string{"app", "lib", "util", "testutil", "orphan"} {
+		pkgs[target] = &Package{Target: target}
+	}
+	pkgs["app"].DepPkgs = []*Package{pkgs["lib"]}
+	pkgs["lib"].DepPkgs = []*Package{pkgs["util"]}
+	pkgs["lib"].TestDepPkgs = []*Package{pkgs["testutil"]}
+
+	workspace := []*Package{pkgs["lib"], pkgs["util"], pkgs["testutil"], pkgs["orphan"]}
+	var unused []string
+	for _, pkg := range UnusedPackages(workspace, []*Package{pkgs["app"]}) {
+		unused = append(unused, pkg.Target)
+	}
+	if fmt.Sprint(unused) != "[orphan]" {
+		t.Error(fmt.Sprintf("UnusedPackages -> %v, was expecting [orphan]", unused))
+	}
+
+	unused = nil
+	for _, pkg := range UnusedPackages(workspace, []*Package{pkgs["lib"]}) {
+		unused = append(unused, pkg.Target)
+	}
+	if fmt.Sprint(unused) != "[lib orphan]" {
+		t.Error(fmt.Sprintf("UnusedPackages -> %v, was expecting [lib orphan]", unused))
+	}
+}
+
+func TestRescanKeepsBrokenTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gb-rescan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCWD, oldGOOS, oldGOARCH := CWD, GOOS, GOARCH
+	CWD, GOOS, GOARCH = dir, "linux", "amd64"
+	defer func() {
+		CWD, GOOS, GOARCH = oldCWD, oldGOOS, oldGOARCH
+	}()
+	src := filepath.Join(dir, "foo.go")
+	write := func(text string) {
+		if err := ioutil.WriteFile(src, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("package foo\n\nfunc F() {}\n")
+	old, err := NewPackage(dir, dir, "", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPackages, oldListedPkgs := Packages, ListedPkgs
+	Packages = map[string]*Package{old.ImportKey(): old}
+	ListedPkgs = []*Package{old}
+	defer func() {
+		Packages, ListedPkgs = oldPackages, oldListedPkgs
+	}()
+
+	// some editors save by removing the file and renaming a new one into place
+	if err = os.Remove(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Rescan(old); err == nil {
+		t.Fatal("Rescan did not report the missing source")
+	}
+	if len(ListedPkgs) != 1 || ListedPkgs[0] != old || Packages[old.ImportKey()] != old {
+		t.Fatal("Rescan dropped a target that failed to scan")
+	}
+
+	write("package foo\n\nfunc F() {}\n")
+	pkg, err := Rescan(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ListedPkgs) != 1 || ListedPkgs[0] != pkg || Packages[pkg.ImportKey()] != pkg {
+		t.Error("Rescan did not list the target again once it scanned")
+	}
+}
+
+func TestDepGraph(t *testing.T) {
+	lib := &Package{Target: "lib"}
+	cgo := &Package{
+		Target:  "testcgo",
+		Deps:    []string{`"C"`, `"cgo"-cmd`, `"lib"`},
+		DepPkgs: []*Package{lib},
+	}
+	oldPackages := Packages
+	Packages = map[string]*Package{`"lib"`: lib, `"testcgo"`: cgo}
+	defer func() {
+		Packages = oldPackages
+	}()
+
+	graph := NewDepGraph()
+	graph.addPackage(cgo)
+	var out bytes.Buffer
+	if err := graph.WriteDOT(&out); err != nil {
+		t.Fatal(err)
+	}
+	truth := "digraph gb {\n" +
+		"\trankdir=LR;\n" +
+		"\t\"lib\" [shape=box];\n" +
+		"\t\"testcgo\" [shape=box];\n" +
+		"\t\"testcgo\" -> \"lib\";\n" +
+		"}\n"
+	if out.String() != truth {
+		t.Error(fmt.Sprintf("WriteDOT wrote\n%s\nwas expecting\n%s", out.String(), truth))
+	}
+}
+
+func TestInstrumentGoto(t *testing.T) {
+	src := `package x
+
+func f(x int) int {
+	if x < 0 {
+		goto done
+	}
+	x++
+done:
+	return x
+}
+
+func g(n int) (x int) {
+	i := 0
+loop:
+	for ; i < n; i++ {
+		if i%2 == 0 {
+			continue loop
+		}
+		x++
+	}
+	if x < 3 {
+		n++
+		goto loop
+	}
+	return
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "x.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []CoverBlock
+	InstrumentFile(fset, file, "x/x.go", &blocks)
+
+	var out bytes.Buffer
+	if err = printer.Fprint(&out, token.NewFileSet(), file); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"done:\n\tGbCoverCount__[2]++\n\treturn x\n",
+		"loop:\n\tGbCoverCount__[5]++\nGbCoverLabel__loop:\n\tfor ",
+		"continue GbCoverLabel__loop\n",
+		"goto loop\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Error(fmt.Sprintf("InstrumentFile wrote\n%s\nwhich does not have %q", out.String(), want))
+		}
+	}
+}
+
+func TestForgetComputedDigest(t *testing.T) {
+	pkgs := make(map[string]*Package)
+	for _, target := range []string{"app", "lib", "util", "other"} {
+		pkgs[target] = &Package{Target: target, digested: true}
+	}
+	pkgs["app"].DepPkgs = []*Package{pkgs["lib"]}
+	pkgs["lib"].DepPkgs = []*Package{pkgs["util"]}
+	oldPackages := Packages
+	Packages = map[string]*Package{}
+	for target, pkg := range pkgs {
+		Packages[`"`+target+`"`] = pkg
+	}
+	defer func() {
+		Packages = oldPackages
+	}()
+
+	pkgs["util"].ForgetComputedDigest()
+	for _, target := range []string{"app", "lib", "util"} {
+		if pkgs[target].digested {
+			t.Error(fmt.Sprintf("ForgetComputedDigest kept the digest of %s", target))
+		}
+	}
+	if !pkgs["other"].digested {
+		t.Error("ForgetComputedDigest forgot the digest of other, which does not import util")
+	}
+}
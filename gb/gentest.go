@@ -23,10 +23,24 @@ import (
 type TestPkg struct {
 	PkgAlias, PkgName, PkgTarget string
 	TestFuncs, TestBenchmarks    []string
+	TestExamples                 []TestExample
+}
+
+type TestExample struct {
+	Name, Output string
 }
 
 type TestSuite struct {
 	TestPkgs []*TestPkg
+
+	// with --cover, the alias of the instrumented package
+	Cover           bool
+	CoverAlias      string
+	CoverCountsFile string
+
+	// with --test-shuffle, the seed the tests were ordered by
+	Shuffled    bool
+	ShuffleSeed int64
 }
 
 var TestmainTemplate = template.Must(template.New("TestSource").Parse(
@@ -36,13 +50,20 @@ var TestmainTemplate = template.Must(template.New("TestSource").Parse(
 {{end}}
 import "testing"
 import __regexp__ "regexp"
-
+{{if .Cover}}import __os__ "os"
+{{end}}{{if or .Cover .Shuffled}}import __fmt__ "fmt"
+{{end}}
 var tests = []testing.InternalTest{
-{{range .TestPkgs}}{{if $PkgName:=.PkgName}}{{if $PkgAlias:=.PkgAlias}}{{range .TestFuncs}}	{"{{$PkgName}}.{{.}}", {{$PkgAlias}}.{{.}}},{{end}}{{end}}{{end}}{{end}}
+{{range .TestPkgs}}{{if $PkgName:=.PkgName}}{{if $PkgAlias:=.PkgAlias}}{{range .TestFuncs}}	{"{{$PkgName}}.{{.}}", {{if $.Cover}}coverTest({{$PkgAlias}}.{{.}}){{else}}{{$PkgAlias}}.{{.}}{{end}}},{{end}}{{end}}{{end}}{{end}}
 }
 
 var benchmarks = []testing.InternalBenchmark{
-{{range .TestPkgs}}{{if $PkgName:=.PkgName}}{{if $PkgAlias:=.PkgAlias}}{{range .TestBenchmarks}}	{"{{$PkgName}}.{{.}}", {{$PkgAlias}}.{{.}}},{{end}}{{end}}{{end}}{{end}}
+{{range .TestPkgs}}{{if $PkgName:=.PkgName}}{{if $PkgAlias:=.PkgAlias}}{{range .TestBenchmarks}}	{"{{$PkgName}}.{{.}}", {{if $.Cover}}coverBenchmark({{$PkgAlias}}.{{.}}){{else}}{{$PkgAlias}}.{{.}}{{end}}},{{end}}{{end}}{{end}}{{end}}
+}
+
+var examples = []testing.InternalExample{
+{{range .TestPkgs}}{{if $PkgName:=.PkgName}}{{if $PkgAlias:=.PkgAlias}}{{range .TestExamples}}	{Name: "{{$PkgName}}.{{.Name}}", F: {{if $.Cover}}coverExample({{$PkgAlias}}.{{.Name}}){{else}}{{$PkgAlias}}.{{.Name}}{{end}}, Output: {{printf "%q" .Output}}},
+{{end}}{{end}}{{end}}{{end}}
 }
 
 var matchPat string
@@ -59,7 +80,40 @@ func matchString(pat, str string) (result bool, err error) {
 	return matchRe.MatchString(str), nil
 }
 
-func main() {
-	testing.Main(matchString, tests, benchmarks, []testing.InternalExample{})
+{{if .Cover}}func writeCover() {
+	f, err := __os__.Create({{printf "%q" .CoverCountsFile}})
+	if err != nil {
+		return
+	}
+	for _, c := range {{.CoverAlias}}.GbCoverCount__ {
+		__fmt__.Fprintln(f, c)
+	}
+	f.Close()
+}
+
+func coverTest(test func(*testing.T)) func(*testing.T) {
+	return func(t *testing.T) {
+		defer writeCover()
+		test(t)
+	}
+}
+
+func coverBenchmark(benchmark func(*testing.B)) func(*testing.B) {
+	return func(b *testing.B) {
+		defer writeCover()
+		benchmark(b)
+	}
+}
+
+func coverExample(example func()) func() {
+	return func() {
+		defer writeCover()
+		example()
+	}
+}
+
+{{end}}func main() {
+{{if .Shuffled}}	__fmt__.Printf("tests shuffled with seed %d\n", {{.ShuffleSeed}})
+{{end}}	testing.Main(matchString, tests, benchmarks, examples)
 }
 `))
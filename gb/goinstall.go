@@ -18,9 +18,9 @@ package main
 
 import (
 	"fmt"
-	"path"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var disabledGCRE = regexp.MustCompile(`^([a-z0-9\-]+\.googlecode\.com/(svn|hg))(/[a-z0-9A-Z_.\-/]*)?$`)
@@ -32,14 +32,19 @@ var goinstallables = []*regexp.Regexp{
 	regexp.MustCompile(`^(github\.com/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(/[a-z0-9A-Z_.\-/]*)?$`),
 	regexp.MustCompile(`^(bitbucket\.org/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(/[a-z0-9A-Z_.\-/]*)?$`),
 	regexp.MustCompile(`^(launchpad\.net/([a-z0-9A-Z_.\-]+(/[a-z0-9A-Z_.\-]+)?|~[a-z0-9A-Z_.\-]+/(\+junk|[a-z0-9A-Z_.\-]+)/[a-z0-9A-Z_.\-]+))(/[a-z0-9A-Z_.\-/]+)?$`),
-	regexp.MustCompile(`.+{\.hg|\.git|\.bzr|\.svn}[/.*]`),
+	regexp.MustCompile(`^([a-z0-9.\-]+\.[a-z0-9.\-]+(:[0-9]+)?/[A-Za-z0-9_.\-/]*?\.(bzr|git|hg|svn))(/[A-Za-z0-9_.\-]+)*$`),
 }
 
 var goinstalledAlready = make(map[string]bool)
+var goinstallLock sync.Mutex
 
 func IsGoInstallable(target string) (matches bool) {
 	target = strings.Trim(target, "\"")
 
+	if remote, _, _ := FindRemote(target); remote != nil {
+		return true
+	}
+
 	for _, re := range goinstallables {
 		if m := re.FindStringSubmatch(target); m != nil {
 			matches = true
@@ -51,13 +56,16 @@ func IsGoInstallable(target string) (matches bool) {
 }
 
 func GoInstallPkg(target string) (touched int64) {
+	goinstallLock.Lock()
+	defer goinstallLock.Unlock()
+
 	if goinstalledAlready[target] {
 		return
 	}
 	goinstalledAlready[target] = true
 
 	if disabledGCRE.FindStringSubmatch(target) != nil {
-		WarnLog.Printf("Googlecode format \"%s\" is no longer accepted - use gofix")
+		WarnLog.Printf("Googlecode format %s is no longer accepted - use gofix", target)
 		return
 	}
 
@@ -67,8 +75,28 @@ func GoInstallPkg(target string) (touched int64) {
 
 	target = strings.Trim(target, "\"")
 
+	update := GoInstallUpdate
+	if GetMirrorDir() != "" {
+		fromTarball, err := FetchFromMirror(target, make(map[string]bool))
+		if err != nil {
+			ErrLog.Printf("%v\n", err)
+			return
+		}
+		// there is no repository for go get -u to update
+		update = update && !fromTarball
+	}
+
+	if remote, _, _ := FindRemote(target); remote != nil {
+		if err := FetchRemote(target, update, make(map[string]bool)); err != nil {
+			ErrLog.Printf("%v\n", err)
+			return
+		}
+		// go get -u would not know where to update it from
+		update = false
+	}
+
 	argv := []string{target}
-	if GoInstallUpdate {
+	if update {
 		argv = []string{"-u", target}
 	}
 
@@ -79,8 +107,29 @@ func GoInstallPkg(target string) (touched int64) {
 		return
 	}
 
-	goinstalledFile := path.Join(GetInstallDirPkg(), target) + ".a"
+	goinstalledFile := InstalledArchive(target)
+	ForgetArchiveDigest(goinstalledFile)
 
 	touched, _ = StatTime(goinstalledFile)
 	return
 }
+
+// ReinstallPkg installs target again from the source already in GOPATH,
+// such as after its checkout has been moved to another revision.
+func ReinstallPkg(target string) (err error) {
+	goinstallLock.Lock()
+	defer goinstallLock.Unlock()
+
+	goinstalledAlready[target] = true
+	target = strings.Trim(target, "\"")
+
+	argv := []string{target}
+	fmt.Printf("%v\n", argv)
+
+	if err = RunExternal(GoInstallCMD, ".", argv); err != nil {
+		return
+	}
+
+	ForgetArchiveDigest(InstalledArchive(target))
+	return
+}
@@ -37,7 +37,7 @@ func GenerateGoyaccSource(this *Package) (err error) {
 		}
 
 		var pkg string
-		pkg, _, _, _, _, _, err = GetDeps(filepath.Join(this.Dir, gosrc))
+		pkg, _, _, _, _, _, _, err = GetDeps(filepath.Join(this.Dir, gosrc))
 		if err != nil {
 			return
 		}
@@ -0,0 +1,181 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+gb --graph writes the resolved target graph in Graphviz's DOT language.
+
+ workspace pkgs are boxes, and workspace cmds are bold boxes
+ GOROOT targets are grey ellipses, GOPATH targets are blue ellipses
+ packages that goinstall can fetch are dashed ellipses
+ imports that can't be resolved are red
+ imports that only come from test source are dashed edges
+*/
+
+type graphNode struct {
+	id    string
+	attrs string
+}
+
+type graphEdge struct {
+	from, to string
+	test     bool
+}
+
+type DepGraph struct {
+	nodes   map[string]graphNode
+	edges   map[graphEdge]bool
+	visited map[*Package]bool
+}
+
+func NewDepGraph() (this *DepGraph) {
+	this = &DepGraph{
+		nodes:   make(map[string]graphNode),
+		edges:   make(map[graphEdge]bool),
+		visited: make(map[*Package]bool),
+	}
+	return
+}
+
+func graphID(pkg *Package) (id string) {
+	id = pkg.Target
+	if pkg.IsCmd {
+		id += " (cmd)"
+	}
+	return
+}
+
+func (this *DepGraph) addPackage(pkg *Package) (id string) {
+	id = graphID(pkg)
+	if this.visited[pkg] {
+		return
+	}
+	this.visited[pkg] = true
+
+	var attrs string
+	switch {
+	case pkg.IsInGOROOT:
+		attrs = "shape=ellipse, color=grey, fontcolor=grey"
+	case pkg.IsInGOPATH != "":
+		attrs = "shape=ellipse, color=blue"
+	case pkg.IsCmd:
+		attrs = "shape=box, style=bold"
+	default:
+		attrs = "shape=box"
+	}
+	this.nodes[id] = graphNode{id, attrs}
+
+	for _, dep := range pkg.DepPkgs {
+		depid := this.addPackage(dep)
+		this.edges[graphEdge{id, depid, false}] = true
+	}
+	for _, dep := range pkg.TestDepPkgs {
+		depid := this.addPackage(dep)
+		if !this.edges[graphEdge{id, depid, false}] {
+			this.edges[graphEdge{id, depid, true}] = true
+		}
+	}
+
+	addExternals := func(deps []string, test bool) {
+		for _, dep := range deps {
+			// build order markers, like "cgo"-cmd, are not imports
+			if dep == "\"C\"" || strings.HasSuffix(dep, "-cmd") {
+				continue
+			}
+			if _, ok := Packages[dep]; ok {
+				continue
+			}
+			target := strings.Trim(dep, "\"")
+			if !this.edges[graphEdge{id, target, false}] {
+				this.edges[graphEdge{id, target, test}] = true
+			}
+			if _, ok := this.nodes[target]; ok {
+				continue
+			}
+			var attrs string
+			if exists, _ := PkgExistsInGOROOT(dep); exists {
+				attrs = "shape=ellipse, color=grey, fontcolor=grey"
+			} else if IsGoInstallable(dep) {
+				attrs = "shape=ellipse, style=dashed"
+			} else {
+				attrs = "shape=ellipse, color=red, fontcolor=red"
+			}
+			this.nodes[target] = graphNode{target, attrs}
+		}
+	}
+	addExternals(pkg.Deps, false)
+	addExternals(pkg.TestDeps, true)
+
+	return
+}
+
+func (this *DepGraph) WriteDOT(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "digraph gb {\n")
+	fmt.Fprintf(bw, "\trankdir=LR;\n")
+
+	var ids []string
+	for id := range this.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(bw, "\t%q [%s];\n", id, this.nodes[id].attrs)
+	}
+
+	var lines []string
+	for e := range this.edges {
+		line := fmt.Sprintf("\t%q -> %q", e.from, e.to)
+		if e.test {
+			line += " [style=dashed]"
+		}
+		lines = append(lines, line+";")
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintf(bw, "%s\n", line)
+	}
+
+	fmt.Fprintf(bw, "}\n")
+
+	err = bw.Flush()
+	return
+}
+
+func TryGraph() (err error) {
+	if GraphOutput {
+		graph := NewDepGraph()
+		for _, pkg := range ListedPkgs {
+			if (pkg.IsCmd && !DoCmds) || (!pkg.IsCmd && !DoPkgs) {
+				continue
+			}
+			graph.addPackage(pkg)
+		}
+		err = graph.WriteDOT(os.Stdout)
+	}
+	return
+}
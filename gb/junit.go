@@ -0,0 +1,304 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+With --junit=DIR, each test binary is run with -test.v and its output is
+read as it is printed. Every test, example and benchmark it reports
+becomes a testcase in DIR/<target>.xml, along with its duration and, for
+failures and skips, the lines it logged. If the binary fails without
+reporting a result for a test it started (a panic, say), that test is
+counted as failed; if it fails without starting any, the binary itself is.
+*/
+
+// the directory given with --junit=DIR
+var JUnitDir string
+
+type JUnitSuite struct {
+	XMLName   xml.Name     `xml:"testsuite"`
+	Name      string       `xml:"name,attr"`
+	Tests     int          `xml:"tests,attr"`
+	Failures  int          `xml:"failures,attr"`
+	Skipped   int          `xml:"skipped,attr"`
+	Time      string       `xml:"time,attr"`
+	Timestamp string       `xml:"timestamp,attr"`
+	Cases     []*JUnitCase `xml:"testcase"`
+	SystemOut string       `xml:"system-out,omitempty"`
+}
+
+type JUnitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *JUnitMessage `xml:"failure,omitempty"`
+	Skipped   *JUnitMessage `xml:"skipped,omitempty"`
+}
+
+type JUnitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// parseTestResult reads a line like "--- PASS: Name (0.01s)" (or, from
+// older test binaries, "(0.01 seconds)").
+func parseTestResult(line string) (status, name string, seconds float64, ok bool) {
+	if !strings.HasPrefix(line, "--- ") {
+		return
+	}
+	fields := strings.Fields(line[len("--- "):])
+	if len(fields) < 2 || !strings.HasSuffix(fields[0], ":") {
+		return
+	}
+	status = strings.TrimSuffix(fields[0], ":")
+	switch status {
+	case "PASS", "FAIL", "SKIP":
+	default:
+		return
+	}
+	name = fields[1]
+	if len(fields) >= 3 && strings.HasPrefix(fields[2], "(") {
+		dur := strings.TrimSuffix(strings.TrimPrefix(fields[2], "("), ")")
+		dur = strings.TrimSuffix(dur, "s")
+		seconds, _ = strconv.ParseFloat(dur, 64)
+	}
+	ok = true
+	return
+}
+
+// parseBenchmarkResult reads a line like "BenchmarkX-4  1000  1234 ns/op".
+func parseBenchmarkResult(line string) (name string, seconds float64, ok bool) {
+	name, n, nsop, ok := parseBenchmarkLine(line)
+	seconds = n * nsop / 1e9
+	return
+}
+
+// isTestMarker reports whether line is one the testing package prints
+// between tests, rather than something a test printed.
+func isTestMarker(line string) bool {
+	if strings.HasPrefix(line, "=== ") || strings.HasPrefix(line, "--- ") {
+		return true
+	}
+	switch strings.TrimSpace(line) {
+	case "PASS", "FAIL":
+		return true
+	}
+	if strings.HasPrefix(line, "exit status ") {
+		return true
+	}
+	_, _, ok := parseBenchmarkResult(line)
+	return ok
+}
+
+// ParseTestOutput finds the result of every test, example and benchmark in
+// the output of a test binary run with -test.v. Tests that were started
+// but never reported are returned in unfinished.
+func ParseTestOutput(output string) (cases []*JUnitCase, unfinished []string) {
+	running := make(map[string]bool)
+	var order []string
+	var last *JUnitCase
+	var msg []string
+
+	flush := func() {
+		if last != nil && len(msg) != 0 {
+			text := strings.Join(msg, "\n")
+			if last.Failure != nil {
+				last.Failure.Message = strings.TrimSpace(msg[0])
+				last.Failure.Text = text
+			} else if last.Skipped != nil {
+				last.Skipped.Message = strings.TrimSpace(msg[0])
+				last.Skipped.Text = text
+			}
+		}
+		last = nil
+		msg = nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if last != nil {
+			// a failed example prints what it got without indenting it
+			indented := strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+			if indented || (last.Failure != nil && !isTestMarker(line)) {
+				msg = append(msg, line)
+				continue
+			}
+		}
+		flush()
+
+		if strings.HasPrefix(line, "=== RUN") {
+			if fields := strings.Fields(line[len("=== RUN"):]); len(fields) != 0 {
+				if !running[fields[0]] {
+					order = append(order, fields[0])
+				}
+				running[fields[0]] = true
+			}
+			continue
+		}
+		if status, name, seconds, ok := parseTestResult(line); ok {
+			delete(running, name)
+			last = &JUnitCase{
+				Name: name,
+				Time: junitSeconds(seconds),
+			}
+			switch status {
+			case "FAIL":
+				last.Failure = &JUnitMessage{Message: "failed"}
+			case "SKIP":
+				last.Skipped = &JUnitMessage{Message: "skipped"}
+			}
+			cases = append(cases, last)
+			continue
+		}
+		if name, seconds, ok := parseBenchmarkResult(line); ok {
+			cases = append(cases, &JUnitCase{
+				Name: name,
+				Time: junitSeconds(seconds),
+			})
+		}
+	}
+	flush()
+
+	for _, name := range order {
+		if running[name] {
+			unfinished = append(unfinished, name)
+		}
+	}
+	return
+}
+
+func (this *Package) JUnitPath() (fpath string) {
+	name := strings.Replace(this.Target, "/", "_", -1)
+	if this.IsCmd {
+		name += "-cmd"
+	}
+	fpath = filepath.Join(GetAbs(JUnitDir, OSWD), name+".xml")
+	return
+}
+
+// WriteJUnit writes the results of this target's test binary, which
+// printed output and exited with runErr, to its file in JUnitDir.
+func (this *Package) WriteJUnit(output string, runErr error, start time.Time, duration time.Duration) (err error) {
+	suite := &JUnitSuite{
+		Name:      this.Target,
+		Time:      junitSeconds(duration.Seconds()),
+		Timestamp: start.Format("2006-01-02T15:04:05"),
+		SystemOut: output,
+	}
+
+	cases, unfinished := ParseTestOutput(output)
+	if runErr != nil {
+		for _, name := range unfinished {
+			cases = append(cases, &JUnitCase{
+				Name:    name,
+				Time:    junitSeconds(0),
+				Failure: &JUnitMessage{"did not finish", runErr.Error()},
+			})
+		}
+		failed := false
+		for _, c := range cases {
+			if c.Failure != nil {
+				failed = true
+			}
+		}
+		if !failed {
+			cases = append(cases, &JUnitCase{
+				Name:    "(test binary)",
+				Time:    suite.Time,
+				Failure: &JUnitMessage{"test binary failed", runErr.Error()},
+			})
+		}
+	}
+
+	for _, c := range cases {
+		c.ClassName = this.Target
+		suite.Tests++
+		if c.Failure != nil {
+			suite.Failures++
+		}
+		if c.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	suite.Cases = cases
+
+	var data []byte
+	data, err = xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return
+	}
+
+	fpath := this.JUnitPath()
+	if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return
+	}
+	var fout *os.File
+	fout, err = os.Create(fpath)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+	if _, err = io.WriteString(fout, xml.Header); err != nil {
+		return
+	}
+	if _, err = fout.Write(data); err != nil {
+		return
+	}
+	_, err = fmt.Fprintln(fout)
+	return
+}
+
+// RunTestJUnit runs a test binary verbosely, passing its output through to
+// out as usual, and records the results with WriteJUnit.
+func (this *Package) RunTestJUnit(testBinary string, args []string, out io.Writer) (err error) {
+	verbose := false
+	for _, arg := range args {
+		if arg == "-test.v" || strings.HasPrefix(arg, "-test.v=") {
+			verbose = true
+		}
+	}
+	if !verbose {
+		args = append([]string{"-test.v"}, args...)
+	}
+
+	var output bytes.Buffer
+	tee := io.MultiWriter(out, &output)
+
+	start := time.Now()
+	err = RunExternalTimeout(testBinary, this.Dir, args, tee, tee, TestTimeout)
+	duration := time.Since(start)
+
+	if werr := this.WriteJUnit(output.String(), err, start, duration); werr != nil {
+		ErrLog.Printf("(in %s) could not write %s: %v\n", this.Dir, this.JUnitPath(), werr)
+	}
+	return
+}
@@ -0,0 +1,248 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+After building with -g or -G, gb writes gb.lock in the workspace root. It
+has a line for each goinstallable package imported by a workspace target,
+or by another such package, giving its import path, the version control
+system of its checkout in GOPATH and the revision that checkout is at:
+
+	github.com/foo/bar git 3f2a...
+
+If nothing goinstallable is imported any more, gb.lock is removed.
+
+With --locked, before anything is built, each of those checkouts is
+updated to the revision in gb.lock, fetching it into the existing clone if
+needed, and the package is installed again. Packages that are not in GOPATH
+yet are fetched first.
+*/
+
+const LockFileName = "gb.lock"
+
+// set by --locked
+var Locked bool
+
+type LockEntry struct {
+	Target, VCS, Revision string
+}
+
+type byLockTarget []*LockEntry
+
+func (b byLockTarget) Len() int           { return len(b) }
+func (b byLockTarget) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLockTarget) Less(i, j int) bool { return b[i].Target < b[j].Target }
+
+func GetLockPath() (fpath string) {
+	return filepath.Join(CWD, LockFileName)
+}
+
+func ReadLockFile() (entries []*LockEntry, err error) {
+	var fin *os.File
+	fin, err = os.Open(GetLockPath())
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	br := bufio.NewReader(fin)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) != 0 && !strings.HasPrefix(fields[0], "#") {
+			if len(fields) != 3 || LookupVCS(fields[1]) == nil {
+				err = errors.New(fmt.Sprintf("%s: bad line %q", GetLockPath(), strings.TrimSpace(line)))
+				return
+			}
+			entries = append(entries, &LockEntry{fields[0], fields[1], fields[2]})
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func WriteLockFile(entries []*LockEntry) (err error) {
+	var fout *os.File
+	fout, err = os.Create(GetLockPath())
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+
+	for _, entry := range entries {
+		if _, err = fmt.Fprintf(fout, "%s %s %s\n", entry.Target, entry.VCS, entry.Revision); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// findGOPATHCheckout finds the checkout in GOPATH that target is in.
+func findGOPATHCheckout(target string) (dir, root string, vcs *VCS, err error) {
+	for _, srcroot := range GOPATH_SRCROOTS {
+		dir = filepath.Join(srcroot, filepath.FromSlash(target))
+		if _, serr := os.Stat(dir); serr == nil {
+			root, vcs, err = FindCheckout(dir, srcroot)
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("\"%s\" is not in GOPATH", target))
+	return
+}
+
+// LockDependencies records the revision of each goinstallable package
+// imported by a workspace target, or by another such package.
+func LockDependencies() (err error) {
+	gm := make(map[string]bool)
+	for _, pkg := range Packages {
+		if pkg.IsInGOROOT || pkg.IsInGOPATH != "" {
+			continue
+		}
+		pkg.CollectGoInstall(gm)
+	}
+
+	var queue []string
+	for dep := range gm {
+		queue = append(queue, dep)
+	}
+	sort.Strings(queue)
+
+	locked := make(map[string]bool)
+	var entries []*LockEntry
+	for len(queue) != 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		// vendored packages are part of the workspace
+		if _, ok := Packages[dep]; ok || locked[dep] {
+			continue
+		}
+		locked[dep] = true
+		target := strings.Trim(dep, "\"")
+
+		dir, root, vcs, cerr := findGOPATHCheckout(target)
+		if cerr != nil {
+			WarnLog.Printf("Not locking \"%s\": %v", target, cerr)
+			continue
+		}
+		queue = append(queue, RemoteImports(dir)...)
+		rev, rerr := vcs.CurrentRevision(root)
+		if rerr != nil {
+			WarnLog.Printf("Not locking \"%s\": %v", target, rerr)
+			continue
+		}
+		entries = append(entries, &LockEntry{target, vcs.Name, rev})
+	}
+	sort.Sort(byLockTarget(entries))
+
+	if len(locked) == 0 {
+		// nothing goinstallable is imported any more
+		if err = os.Remove(GetLockPath()); err == nil {
+			fmt.Printf("Removed %s\n", GetLockPath())
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err = WriteLockFile(entries); err != nil {
+		return
+	}
+	fmt.Printf("Wrote %s\n", GetLockPath())
+	return
+}
+
+// CheckoutLocked puts the checkout of each package in gb.lock at the
+// revision recorded there, and installs the package again.
+func CheckoutLocked() (err error) {
+	var entries []*LockEntry
+	if entries, err = ReadLockFile(); err != nil {
+		return
+	}
+
+	checkedOut := make(map[string]string)
+	for _, entry := range entries {
+		dep := "\"" + entry.Target + "\""
+		_, root, vcs, cerr := findGOPATHCheckout(entry.Target)
+		if cerr != nil {
+			// not fetched yet
+			GoInstallPkg(dep)
+			_, root, vcs, cerr = findGOPATHCheckout(entry.Target)
+		}
+		if cerr != nil {
+			err = errors.New(fmt.Sprintf("could not check out \"%s\": %v", entry.Target, cerr))
+			return
+		}
+		if vcs.Name != entry.VCS {
+			err = errors.New(fmt.Sprintf("\"%s\" is locked to a %s revision, but %s is a %s checkout", entry.Target, entry.VCS, root, vcs.Name))
+			return
+		}
+
+		if rev, ok := checkedOut[root]; ok {
+			if rev != entry.Revision {
+				err = errors.New(fmt.Sprintf("%s is locked to both %s and %s", root, rev, entry.Revision))
+				return
+			}
+		} else {
+			checkedOut[root] = entry.Revision
+			if rev, rerr := vcs.CurrentRevision(root); rerr != nil || rev != entry.Revision {
+				fmt.Printf("Checking out %s %s in %s\n", entry.VCS, entry.Revision, root)
+				if err = vcs.CheckoutRevision(root, entry.Revision); err != nil {
+					err = errors.New(fmt.Sprintf("could not check out %s in %s: %v", entry.Revision, root, err))
+					return
+				}
+			}
+		}
+
+		if err = ReinstallPkg(dep); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func TryLocked() (err error) {
+	if Locked {
+		err = CheckoutLocked()
+	}
+	return
+}
+
+func TryLock() (err error) {
+	if GoInstall && !Locked {
+		err = LockDependencies()
+	}
+	return
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 )
 
 func MakeBuild(pkg *Package) (err error) {
@@ -57,10 +58,10 @@ func MakeClean(pkg *Package) (err error) {
 	return
 }
 
-func MakeTest(pkg *Package) (err error) {
+func MakeTest(pkg *Package, out io.Writer) (err error) {
 	margs := []string{"test"}
-	fmt.Printf("(in %v)\n", pkg.Dir)
-	fmt.Printf("%v\n", margs)
-	err = RunExternal(MakeCMD, pkg.Dir, margs)
+	fmt.Fprintf(out, "(in %v)\n", pkg.Dir)
+	fmt.Fprintf(out, "%v\n", margs)
+	err = RunExternalTimeout(MakeCMD, pkg.Dir, margs, out, out, TestTimeout)
 	return
 }
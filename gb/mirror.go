@@ -0,0 +1,290 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+A mirror is a local directory of the repositories that goinstallable
+packages come from, laid out by import path. It is set with mirror=<dir>
+in the gb.cfg at the root of the workspace, or with $GB_MIRROR, which
+takes precedence. A relative path is taken from the workspace root.
+
+For an import path such as github.com/foo/bar/baz, gb looks for the
+longest prefix that the mirror has one of
+
+	<prefix>.git or <prefix>   a git repository, bare or not
+	<prefix>                   an hg or bzr repository
+	<prefix>.tar.gz, <prefix>.tgz or <prefix>.tar
+
+and, with -g, clones or unpacks it into GOPATH/src/<prefix> before
+installing the package, so that nothing is fetched from the network. A
+clone's origin is the mirror, so -G updates it from the mirror too; a
+tarball is unpacked again. If a tarball holds everything in a single
+top-level directory, that directory is left out.
+
+A package that is not in the mirror is an error, rather than something
+to fetch from the network, unless it is already in GOPATH and -G was not
+given.
+*/
+
+const MirrorEnv = "GB_MIRROR"
+
+var mirrorDir string
+var mirrorLoaded bool
+
+// GetMirrorDir returns the mirror directory, if there is one.
+func GetMirrorDir() (dir string) {
+	if !mirrorLoaded {
+		mirrorLoaded = true
+		dir = os.Getenv(MirrorEnv)
+		if dir == "" {
+			dir, _ = ReadConfig(CWD).Mirror()
+		}
+		if dir != "" {
+			mirrorDir = GetAbs(dir, CWD)
+		}
+	}
+	return mirrorDir
+}
+
+type MirrorEntry struct {
+	Root string // the import path prefix the entry is for
+	Path string
+	Kind string // "git", "hg", "bzr" or "tar"
+}
+
+func isDir(fpath string) bool {
+	info, err := os.Stat(fpath)
+	return err == nil && info.IsDir()
+}
+
+func isFile(fpath string) bool {
+	info, err := os.Stat(fpath)
+	return err == nil && !info.IsDir()
+}
+
+// repoKind says which version control system the repository in dir
+// belongs to.
+func repoKind(dir string) (kind string) {
+	switch {
+	case isDir(filepath.Join(dir, ".git")):
+		return "git"
+	case isFile(filepath.Join(dir, "HEAD")) && isDir(filepath.Join(dir, "objects")):
+		return "git"
+	case isDir(filepath.Join(dir, ".hg")):
+		return "hg"
+	case isDir(filepath.Join(dir, ".bzr")):
+		return "bzr"
+	}
+	return
+}
+
+// FindInMirror looks for the repository that target is in.
+func FindInMirror(mirror, target string) (entry *MirrorEntry, found bool) {
+	for root := target; root != "." && root != "/" && root != ""; root = path.Dir(root) {
+		base := filepath.Join(mirror, filepath.FromSlash(root))
+		for _, dir := range []string{base + ".git", base} {
+			if kind := repoKind(dir); kind != "" {
+				entry, found = &MirrorEntry{root, dir, kind}, true
+				return
+			}
+		}
+		for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+			if isFile(base + ext) {
+				entry, found = &MirrorEntry{root, base + ext, "tar"}, true
+				return
+			}
+		}
+	}
+	return
+}
+
+// tarballPrefix returns the top-level directory that every name is in, if
+// there is just one.
+func tarballPrefix(names []string) (prefix string) {
+	inDir := false
+	for _, name := range names {
+		name = strings.TrimPrefix(path.Clean(name), "./")
+		first := name
+		if slash := strings.Index(name, "/"); slash != -1 {
+			first = name[:slash]
+			inDir = true
+		}
+		if prefix == "" {
+			prefix = first
+		} else if first != prefix {
+			return ""
+		}
+	}
+	if !inDir {
+		// a single file, rather than a directory
+		prefix = ""
+	}
+	return
+}
+
+func readTarball(fpath string, each func(hdr *tar.Header, r io.Reader) error) (err error) {
+	var fin *os.File
+	fin, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	var r io.Reader = fin
+	if !strings.HasSuffix(fpath, ".tar") {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(fin); err != nil {
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err = each(hdr, tr); err != nil {
+			return
+		}
+	}
+}
+
+// UnpackTarball unpacks the tarball at fpath into dst.
+func UnpackTarball(fpath, dst string) (err error) {
+	var names []string
+	err = readTarball(fpath, func(hdr *tar.Header, r io.Reader) error {
+		names = append(names, hdr.Name)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	prefix := tarballPrefix(names)
+
+	return readTarball(fpath, func(hdr *tar.Header, r io.Reader) (err error) {
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if prefix != "" {
+			if name == prefix {
+				return
+			}
+			name = strings.TrimPrefix(name, prefix+"/")
+		}
+		if name == "." || name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return
+			}
+			var fout *os.File
+			fout, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm()|0600)
+			if err != nil {
+				return
+			}
+			defer fout.Close()
+			_, err = io.Copy(fout, r)
+		}
+		return
+	})
+}
+
+// FetchFromMirror puts the repository that target is in into GOPATH from
+// the mirror, along with those of the goinstallable packages it imports.
+// It returns whether target came from a tarball, which go get -u cannot
+// update.
+func FetchFromMirror(target string, fetched map[string]bool) (fromTarball bool, err error) {
+	mirror := GetMirrorDir()
+	entry, found := FindInMirror(mirror, target)
+	if !found {
+		// go get would only go to the network for it
+		if _, inGOPATH := FindInGOPATH(target); !inGOPATH || GoInstallUpdate {
+			err = errors.New(fmt.Sprintf("\"%s\" is not in the mirror %s", target, mirror))
+		}
+		return
+	}
+	fromTarball = entry.Kind == "tar"
+	if fetched[entry.Root] {
+		return
+	}
+	fetched[entry.Root] = true
+
+	if GOPATH_SINGLE == "" {
+		err = errors.New(fmt.Sprintf("cannot fetch \"%s\" from the mirror without a GOPATH", target))
+		return
+	}
+	dst := filepath.Join(GOPATH_SINGLE, "src", filepath.FromSlash(entry.Root))
+
+	_, inGOPATH := FindInGOPATH(target)
+	if fromTarball && GoInstallUpdate && inGOPATH {
+		if err = os.RemoveAll(dst); err != nil {
+			return
+		}
+		inGOPATH = false
+	}
+
+	if !inGOPATH {
+		fmt.Printf("Fetching \"%s\" from %s\n", entry.Root, entry.Path)
+		if entry.Kind == "tar" {
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+				err = UnpackTarball(entry.Path, dst)
+			}
+		} else {
+			err = LookupVCS(entry.Kind).CloneInto(entry.Path, dst)
+		}
+		if err != nil {
+			err = errors.New(fmt.Sprintf("could not fetch \"%s\" from %s: %v", entry.Root, entry.Path, err))
+			return
+		}
+	}
+
+	dir, _ := FindInGOPATH(target)
+	for _, dep := range RemoteImports(dir) {
+		depTarget := strings.Trim(dep, "\"")
+		if _, ok := FindInGOPATH(depTarget); ok && !GoInstallUpdate {
+			continue
+		}
+		if _, err = FetchFromMirror(depTarget, fetched); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -18,18 +18,23 @@ package main
 
 import (
 	//"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 )
 
 type Package struct {
 	Dir, Base string
 
+	scanBase string // the base that NewPackage was given, for rescanning
+
 	Cfg Config
 
 	Name, Target string
@@ -50,7 +55,7 @@ type Package struct {
 	YaccGoSrcs []string // the .go files that correspond to .y files
 
 	//these prevent multipath issues for tree following
-	built, cleaned, addedToBuild, gofmted, gofixed, scanned bool
+	built, cleaned, addedToBuild, gofmted, gofixed, scanned, digested bool
 
 	NeedsBuild, NeedsInstall, NeedsGoInstall bool
 
@@ -73,10 +78,29 @@ type Package struct {
 	Deps    []string
 	DepPkgs []*Package
 
+	// imports that ResolveDeps could not find, with the reason
+	Unresolved map[string]string
+
 	TestSources []string
 	TestDeps    []string
+	// the imports of each test source file, by file
+	TestSrcDeps map[string][]string
+	// the imports of each package found in test source, by package name
+	TestPkgDeps map[string][]string
 	TestFuncs   map[string][]string
-	TestDepPkgs []*Package
+	// the expected output of each example function with an Output comment,
+	// by "pkgname.ExampleName"
+	ExampleOutputs map[string]string
+	TestDepPkgs    []*Package
+
+	// whether the last test run was skipped, since it had already passed
+	TestCached bool
+	// whether the last test run was skipped, since its test binary could
+	// not be built on its own
+	TestSkipped bool
+
+	// with --cover, the blocks counted in the last instrumented build
+	CoverBlocks []CoverBlock
 
 	CGoCFlags  map[string][]string
 	CGoLDFlags map[string][]string
@@ -87,12 +111,17 @@ type Package struct {
 	IsInGOPATH      string
 	InTestData      string
 
-	SourceTime, BinTime, InstTime, GOROOTPkgTime int64
+	SourceTime, BinTime, InstTime int64
+
+	ExtArchives []string // archives of imported packages that gb does not build
+	Digest      string
 
 	FailedToBuild bool
 
 	//to make sure that only one thread works on a given package at a time
 	block chan bool
+	// guards Digest and digested, since test workers share dependencies
+	digestLock sync.Mutex
 }
 
 func NewPackage(base, dir string, inTestData string, cfg Config) (this *Package, err error) {
@@ -112,7 +141,9 @@ func NewPackage(base, dir string, inTestData string, cfg Config) (this *Package,
 	this.PkgSrc = make(map[string][]string)
 	this.PkgCGoSrc = make(map[string][]string)
 	this.TestSrc = make(map[string][]string)
+	this.TestPkgDeps = make(map[string][]string)
 	this.TestFuncs = make(map[string][]string)
+	this.ExampleOutputs = make(map[string]string)
 
 	this.CGoCFlags = make(map[string][]string)
 	this.CGoLDFlags = make(map[string][]string)
@@ -150,6 +181,7 @@ func NewPackage(base, dir string, inTestData string, cfg Config) (this *Package,
 	this.FilterDeadSource()
 
 	this.Base = base
+	this.scanBase = base
 	this.DepPkgs = make([]*Package, 0)
 
 	if strings.HasPrefix(this.Dir, "./") {
@@ -250,32 +282,6 @@ func NewPackage(base, dir string, inTestData string, cfg Config) (this *Package,
 	return
 }
 
-func (this *Package) DetectCycles() (cycle []*Package) {
-	cycle = this.detectCycle(nil)
-	return
-}
-
-func (this *Package) detectCycle(visited []*Package) (cycle []*Package) {
-	for i, p := range visited {
-		if p == this {
-			_ = i
-			cycle = append(visited, this)
-			return
-		}
-	}
-
-	visited = append(visited, this)
-
-	for _, pkg := range this.DepPkgs {
-		cycle = pkg.detectCycle(visited)
-		if cycle != nil {
-			return
-		}
-	}
-
-	return
-}
-
 func (this *Package) ScanForSource() (err error) {
 	errch := make(chan error)
 	go func() {
@@ -456,13 +462,19 @@ func (this *Package) GetSourceDeps() (err error) {
 	this.SrcDeps = make(map[string][]string)
 
 	var nonCGoSrc []string
+	excluded := make(map[string]bool)
 
 	for _, src := range this.GoSources {
 		var fpkg, ftarget string
 		var fdeps []string
 		var cflags, ldflags []string
-		fpkg, ftarget, fdeps, _, cflags, ldflags, err = GetDeps(path.Join(this.Dir, src))
+		fpkg, ftarget, fdeps, _, _, cflags, ldflags, err = GetDeps(path.Join(this.Dir, src))
 
+		if err == ErrExcludedByTags {
+			excluded[src] = true
+			err = nil
+			continue
+		}
 		if err != nil {
 			BrokenMsg = append(BrokenMsg, fmt.Sprintf("(in %s) %s", this.Dir, err.Error()))
 			continue
@@ -530,11 +542,19 @@ func (this *Package) GetSourceDeps() (err error) {
 
 	this.Deps = RemoveDups(this.Deps)
 
-	if Test {
+	if Test || GraphOutput || DepCheck {
+		this.TestSrcDeps = make(map[string][]string)
 		for _, src := range this.TestSources {
 			var fpkg, ftarget string
 			var fdeps, ffuncs []string
-			fpkg, ftarget, fdeps, ffuncs, _, _, err = GetDeps(path.Join(this.Dir, src))
+			var foutputs map[string]string
+			fpkg, ftarget, fdeps, ffuncs, foutputs, _, _, err = GetDeps(path.Join(this.Dir, src))
+			if err == ErrExcludedByTags {
+				excluded[src] = true
+				err = nil
+				continue
+			}
+			this.TestSrcDeps[src] = fdeps
 			if this.Name != "\"runtime\"" {
 				fdeps = append(fdeps, "\"runtime\"")
 			}
@@ -553,9 +573,38 @@ func (this *Package) GetSourceDeps() (err error) {
 				this.Target = ftarget
 			}
 			this.TestDeps = append(this.TestDeps, fdeps...)
+			this.TestPkgDeps[fpkg] = append(this.TestPkgDeps[fpkg], fdeps...)
 			this.TestFuncs[fpkg] = append(this.TestFuncs[fpkg], ffuncs...)
+			for f, output := range foutputs {
+				this.ExampleOutputs[fpkg+"."+f] = output
+			}
 		}
 		this.TestDeps = RemoveDups(this.TestDeps)
+
+		// imports of test-only packages are satisfied by _test/_obj
+		var testDeps []string
+		for _, dep := range this.TestDeps {
+			if name := dep[1 : len(dep)-1]; name == this.Name || this.TestSrc[name] == nil {
+				testDeps = append(testDeps, dep)
+			}
+		}
+		this.TestDeps = testDeps
+	}
+
+	// files left out by build constraints stay in DeadSources only
+	if len(excluded) != 0 {
+		var sources, testSources []string
+		for _, src := range this.Sources {
+			if !excluded[src] {
+				sources = append(sources, src)
+			}
+		}
+		for _, src := range this.TestSources {
+			if !excluded[src] {
+				testSources = append(testSources, src)
+			}
+		}
+		this.Sources, this.TestSources = sources, testSources
 	}
 
 	return
@@ -778,6 +827,10 @@ func (this *Package) CheckStatus() {
 }
 
 func (this *Package) ResolveDeps() (err error) {
+	this.DepPkgs = []*Package{}
+	this.TestDepPkgs = nil
+	this.ExtArchives = nil
+	this.Unresolved = make(map[string]string)
 
 	CheckDeps := func(deps []string, test bool) (err error) {
 		for _, dep := range deps {
@@ -792,25 +845,26 @@ func (this *Package) ResolveDeps() (err error) {
 					this.DepPkgs = append(this.DepPkgs, pkg)
 				}
 			} else {
-				exists, when := PkgExistsInGOROOT(dep)
+				exists, _ := PkgExistsInGOROOT(dep)
 
-				if exists {
-					if this.GOROOTPkgTime < when {
-						this.GOROOTPkgTime = when
-					}
+				if exists && !test {
+					this.ExtArchives = append(this.ExtArchives, GOROOTArchive(dep))
 				}
 				if !IsGoInstallable(dep) {
 					if !exists {
-						//fmt.Printf("in %s: can't resolve pkg %s (maybe you aren't in the root?)\n", this.Dir, dep)
+						this.unresolved(dep, NotGoInstallable)
 						err = errors.New("unresolved packages")
 					}
 				} else {
+					if !test {
+						this.ExtArchives = append(this.ExtArchives, InstalledArchive(dep))
+					}
 					if GoInstallUpdate {
 						this.NeedsBuild = true
 					}
 					if !exists {
 						if !GoInstall {
-							//fmt.Printf("in %s: can't resolve pkg %s (try using -g)\n", this.Dir, dep)
+							this.unresolved(dep, NotGoInstalled)
 							err = errors.New("unresolved packages")
 						} else {
 							this.NeedsGoInstall = true
@@ -824,32 +878,31 @@ func (this *Package) ResolveDeps() (err error) {
 		return
 	}
 	for i, dep := range this.Deps {
-		if strings.HasPrefix(dep, "\"./") {
-			//WarnLog.Printf("(in %s) gb does not support relative import %s", this.Dir, dep)
-			unquoted := dep[1 : len(dep)-1]
-			dep = "\"" + path.Join(this.Base, unquoted) + "\""
-		}
-		this.Deps[i] = dep
+		this.Deps[i] = this.resolveRelative(dep)
 	}
 	err = CheckDeps(this.Deps, false)
-	if err != nil {
-		return
-	}
 	for i, dep := range this.TestDeps {
-		if strings.HasPrefix(dep, "\"./") {
-			//WarnLog.Printf("(in %s) gb does not support relative import %s", this.Dir, dep)
-			unquoted := dep[1 : len(dep)-1]
-			dep = "\"" + path.Join(this.Base, unquoted) + "\""
-		}
-		this.TestDeps[i] = dep
+		this.TestDeps[i] = this.resolveRelative(dep)
+	}
+	// look at the test imports even if the others failed, so that all
+	// unresolved imports are known
+	if terr := CheckDeps(this.TestDeps, true); err == nil {
+		err = terr
 	}
-	err = CheckDeps(this.TestDeps, true)
 	return
 }
 
-func (this *Package) Touched() (build, install bool) {
-	var inTime int64
+// resolveRelative turns an import like "./foo" into the target it refers to.
+func (this *Package) resolveRelative(dep string) string {
+	if strings.HasPrefix(dep, "\"./") {
+		//WarnLog.Printf("(in %s) gb does not support relative import %s", this.Dir, dep)
+		unquoted := dep[1 : len(dep)-1]
+		dep = "\"" + path.Join(this.Base, unquoted) + "\""
+	}
+	return dep
+}
 
+func (this *Package) Touched() (build, install bool) {
 	build = this.NeedsBuild
 	install = this.NeedsInstall
 
@@ -861,23 +914,12 @@ func (this *Package) Touched() (build, install bool) {
 		if di {
 			install = true
 		}
-		if pkg.BinTime > inTime {
-			inTime = pkg.BinTime
-		}
 	}
 
-	if this.GOROOTPkgTime > inTime {
-		inTime = this.GOROOTPkgTime
-	}
-
-	if this.SourceTime > inTime {
-		inTime = this.SourceTime
-	}
-
-	if inTime > this.BinTime {
+	if this.Stale() {
 		build = true
 	}
-	if this.InstTime < this.BinTime || this.InstTime < inTime {
+	if this.InstTime < this.BinTime {
 		install = true
 	}
 
@@ -889,6 +931,13 @@ func (this *Package) Touched() (build, install bool) {
 }
 
 func (this *Package) Build() (err error) {
+	return this.build(true)
+}
+
+// build brings this target up to date. If recurse is false, the targets in
+// DepPkgs are assumed to have been dealt with already, as they are when the
+// build is driven by a BuildScheduler.
+func (this *Package) build(recurse bool) (err error) {
 	this.block <- true
 	defer func() {
 		<-this.block
@@ -924,44 +973,34 @@ func (this *Package) Build() (err error) {
 		return
 	}
 
-	inTime := this.GOROOTPkgTime
-
-	if Concurrent {
+	if recurse {
 		for _, pkg := range this.DepPkgs {
-			go pkg.Build()
-		}
-	}
-
-	for _, pkg := range this.DepPkgs {
-
-		err = pkg.Build()
-		if err != nil {
-			return
-		}
-		if pkg.BinTime > inTime {
-			inTime = pkg.BinTime
+			err = pkg.Build()
+			if err != nil {
+				return
+			}
 		}
 	}
 	if GoInstall {
+		goinstalled := false
 		for _, dep := range this.Deps {
 			if _, ok := Packages[dep]; !ok {
-				goinstTime := GoInstallPkg(dep)
-				if goinstTime > inTime {
-					inTime = goinstTime
+				if GoInstallPkg(dep) != 0 {
+					goinstalled = true
 				}
 			}
 		}
+		if goinstalled {
+			// the imported archives may have changed underneath us
+			this.ForgetComputedDigest()
+		}
 	}
 
 	if !this.Active {
 		return
 	}
 
-	if this.SourceTime > inTime {
-		inTime = this.SourceTime
-	}
-
-	if inTime > this.BinTime {
+	if this.Stale() {
 		which := "cmd"
 		if this.Name != "main" {
 			which = "pkg"
@@ -996,10 +1035,14 @@ func (this *Package) Build() (err error) {
 			}
 		}
 		if err == nil {
-			PackagesBuilt++
+			this.Stat()
+			if err = RecordDigest(this); err != nil {
+				return
+			}
+			Tally(&PackagesBuilt)
 		} else {
-			BrokenPackages++
-			BrokenMsg = append(BrokenMsg, fmt.Sprintf("(in %s) could not build \"%s\"", this.Dir, this.Target))
+			Tally(&BrokenPackages)
+			ReportBroken(fmt.Sprintf("(in %s) could not build \"%s\"", this.Dir, this.Target))
 		}
 
 	}
@@ -1016,7 +1059,27 @@ func (this *Package) Build() (err error) {
 
 	return
 }
-func (this *Package) Test() (err error) {
+
+// depsFailed marks this target as unbuildable because one of its
+// dependencies could not be built.
+func (this *Package) depsFailed() {
+	this.block <- true
+	defer func() {
+		<-this.block
+	}()
+
+	if this.FailedToBuild {
+		return
+	}
+	this.FailedToBuild = true
+	if this.NeedsBuild && !MakeAMess {
+		this.CleanFiles()
+	}
+}
+
+// Test builds and runs this target's tests, writing what they print to out.
+func (this *Package) Test(out io.Writer) (err error) {
+	this.TestSkipped = false
 	for _, pkg := range this.TestDepPkgs {
 		err = pkg.Build()
 		if err != nil {
@@ -1032,25 +1095,73 @@ func (this *Package) Test() (err error) {
 	}
 
 	if (Makefiles && this.HasMakefile) || this.IsCGo {
-		err = MakeTest(this)
+		if Cover {
+			WarnLog.Printf("(in %s) No coverage for tests run with make", this.Dir)
+		}
+		if JUnitDir != "" {
+			WarnLog.Printf("(in %s) No JUnit results for tests run with make", this.Dir)
+		}
+		if TestCompileOnly {
+			WarnLog.Printf("(in %s) Cannot build tests with make without running them", this.Dir)
+			this.TestSkipped = true
+			return
+		}
+		err = MakeTest(this, out)
 		return
 	}
 
+	// the output of the tests themselves goes to out, which may also be
+	// recorded for the cache
+	console := out
+
+	this.TestCached = false
+	if !ForceRetest && !Cover && JUnitDir == "" && !Benchmarking() && !TestCompileOnly {
+		digest := this.ComputeTestDigest()
+		if output, ok := this.CachedTestOutput(digest); ok {
+			fmt.Fprintf(out, "(in %s) testing \"%s\" (cached)\n", this.Dir, this.Target)
+			out.Write(output)
+			this.TestCached = true
+			return
+		}
+
+		// runs after the _test directory is removed, so err is final
+		var output bytes.Buffer
+		out = io.MultiWriter(out, &output)
+		defer func() {
+			if err != nil {
+				this.ForgetTestOutput()
+				return
+			}
+			if cerr := this.CacheTestOutput(digest, output.Bytes()); cerr != nil {
+				WarnLog.Printf("(in %s) Could not cache test results: %v", this.Dir, cerr)
+			}
+		}()
+	}
+
 	testdir := path.Join(this.Dir, "_test")
-	if !MakeAMess {
+	// with --test-compile-only, the binary is left to be run later
+	if !MakeAMess && !TestCompileOnly {
 		defer func() {
 			if Verbose {
-				fmt.Printf(" Removing %s\n", testdir)
+				fmt.Fprintf(out, " Removing %s\n", testdir)
+			}
+			// don't let a clean removal hide a failed test
+			if rerr := os.RemoveAll(testdir); err == nil {
+				err = rerr
 			}
-			err = os.RemoveAll(testdir)
 		}()
 	}
 
-	fmt.Printf("(in %s) testing \"%s\"\n", this.Dir, this.Target)
+	if TestCompileOnly {
+		fmt.Fprintf(console, "(in %s) building tests for \"%s\"\n", this.Dir, this.Target)
+	} else {
+		fmt.Fprintf(console, "(in %s) testing \"%s\"\n", this.Dir, this.Target)
+	}
 
 	var pkgtests, pkgbenchmarks map[string][]string
 	pkgtests = make(map[string][]string)
 	pkgbenchmarks = make(map[string][]string)
+	pkgexamples := make(map[string][]TestExample)
 
 	for name, funcs := range this.TestFuncs {
 		for _, f := range funcs {
@@ -1060,6 +1171,9 @@ func (this *Package) Test() (err error) {
 			if strings.HasPrefix(f, "Benchmark") {
 				pkgbenchmarks[name] = append(pkgbenchmarks[name], f)
 			}
+			if output, ok := this.ExampleOutputs[name+"."+f]; ok {
+				pkgexamples[name] = append(pkgexamples[name], TestExample{f, output})
+			}
 		}
 	}
 
@@ -1112,6 +1226,27 @@ func (this *Package) Test() (err error) {
 		}
 	}
 
+	for name, examples := range pkgexamples {
+		if _, ok := testpkgMap[name]; !ok {
+			targ := name
+
+			if name == this.Name {
+				targ = this.Target
+			}
+			testpkgMap[name] = &TestPkg{
+				PkgAlias:  name,
+				PkgName:   name,
+				PkgTarget: targ,
+			}
+		}
+
+		tpkg := testpkgMap[name]
+
+		for _, example := range examples {
+			tpkg.TestExamples = append(tpkg.TestExamples, example)
+		}
+	}
+
 	for _, tpkg := range testpkgMap {
 		if tpkg.PkgName == "main" {
 			tpkg.PkgAlias = "__main__"
@@ -1119,13 +1254,31 @@ func (this *Package) Test() (err error) {
 		testSuite.TestPkgs = append(testSuite.TestPkgs, tpkg)
 	}
 
+	if TestShuffle {
+		testSuite.Shuffle(TestShuffleSeed)
+	}
+
+	if Cover {
+		// the test main can only get at the counters if it imports the target
+		if tpkg, ok := testpkgMap[this.Name]; ok && tpkg.PkgTarget != "" {
+			testSuite.Cover = true
+			testSuite.CoverAlias = tpkg.PkgAlias
+			testSuite.CoverCountsFile = CoverCountsFile
+		} else {
+			WarnLog.Printf("(in %s) No coverage for \"%s\", since it has no tests of its own", this.Dir, this.Target)
+		}
+	}
+
 	err = TestmainTemplate.Execute(file, testSuite)
 	if err != nil {
 		return
 	}
 	file.Close()
 
-	err = BuildTest(this)
+	err = BuildTest(this, testSuite.Cover, out)
+	if err != nil && testSuite.Shuffled && !TestCompileOnly {
+		fmt.Fprintf(out, "(in %s) the tests of \"%s\" were shuffled with seed %d; use --test-shuffle=%d to run them in the same order\n", this.Dir, this.Target, testSuite.ShuffleSeed, testSuite.ShuffleSeed)
+	}
 
 	this.Stat()
 
@@ -1141,7 +1294,7 @@ func (this *Package) CleanFiles() (err error) {
 
 	if Makefiles && this.HasMakefile {
 		MakeClean(this)
-		PackagesCleaned++
+		Tally(&PackagesCleaned)
 		return
 	}
 
@@ -1202,7 +1355,7 @@ func (this *Package) CleanFiles() (err error) {
 		return
 	}
 	fmt.Printf("Cleaning %s\n", this.Dir)
-	PackagesCleaned++
+	Tally(&PackagesCleaned)
 	for _, obj := range this.Objects {
 		if Verbose {
 			fmt.Printf(" Removing %s\n", obj)
@@ -1292,7 +1445,7 @@ func (this *Package) Install() (err error) {
 
 		this.Stat()
 
-		PackagesInstalled++
+		Tally(&PackagesInstalled)
 	}
 	return
 }
@@ -0,0 +1,146 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+type Platform struct {
+	GOOS, GOARCH string
+}
+
+func (p Platform) String() string {
+	return p.GOOS + "/" + p.GOARCH
+}
+
+func (p Platform) IsNative() bool {
+	return p.GOOS == runtime.GOOS && p.GOARCH == runtime.GOARCH
+}
+
+// the platforms given with --platforms
+var Platforms []Platform
+
+func ParsePlatforms(list string) (platforms []Platform, err error) {
+	seen := make(map[Platform]bool)
+	for _, pstr := range strings.Split(list, ",") {
+		pstr = strings.TrimSpace(pstr)
+		if pstr == "" {
+			continue
+		}
+		parts := strings.Split(pstr, "/")
+		if len(parts) != 2 {
+			err = errors.New(fmt.Sprintf("platform %q is not of the form GOOS/GOARCH", pstr))
+			return
+		}
+		p := Platform{parts[0], parts[1]}
+		if !os_flags[p.GOOS] {
+			err = errors.New(fmt.Sprintf("Unknown GOOS %s", p.GOOS))
+			return
+		}
+		if !arch_flags[p.GOARCH] {
+			err = errors.New(fmt.Sprintf("Unknown GOARCH %s", p.GOARCH))
+			return
+		}
+		if !seen[p] {
+			seen[p] = true
+			platforms = append(platforms, p)
+		}
+	}
+	if len(platforms) == 0 {
+		err = errors.New("no platforms listed")
+	}
+	return
+}
+
+func SetPlatform(p Platform) (err error) {
+	GOOS, GOARCH = p.GOOS, p.GOARCH
+	os.Setenv("GOOS", GOOS)
+	os.Setenv("GOARCH", GOARCH)
+	LoadPlatformEnvs()
+	err = FindExternals()
+	return
+}
+
+// ResetRunState forgets everything RunGB learned, so that it can be run
+// again from scratch.
+func ResetRunState() {
+	Packages = make(map[string]*Package)
+	ListedTargets = 0
+	ListedPkgs = nil
+	resetStatus()
+
+	manifest = make(map[string]string)
+	archiveDigests = make(map[string]string)
+	goinstalledAlready = make(map[string]bool)
+}
+
+type platformResult struct {
+	platform                 Platform
+	built, installed, broken int
+	err                      error
+}
+
+// RunPlatforms runs the whole scan and build once for each platform given
+// with --platforms, and reports how each one went.
+func RunPlatforms() (failed bool) {
+	test := Test
+	defer func() {
+		Test = test
+	}()
+
+	var results []platformResult
+	for _, p := range Platforms {
+		fmt.Printf("Building for %s\n", p)
+
+		ResetRunState()
+		res := platformResult{platform: p}
+
+		if res.err = SetPlatform(p); res.err == nil {
+			Test = test
+			if Test && !p.IsNative() {
+				WarnLog.Printf("Not running tests for %s", p)
+				Test = false
+			}
+			res.err = RunGB()
+		}
+		if res.err != nil {
+			ErrLog.Printf("%v\n", res.err)
+		}
+
+		res.built, res.installed, res.broken = PackagesBuilt, PackagesInstalled, BrokenPackages
+		if res.err != nil || len(BrokenMsg) != 0 {
+			failed = true
+		}
+		results = append(results, res)
+	}
+
+	fmt.Printf("Platform results:\n")
+	for _, res := range results {
+		status := "ok"
+		if res.err != nil || res.broken != 0 {
+			status = "FAIL"
+		}
+		fmt.Printf(" %-4s %-16s built %d, installed %d, broken %d\n",
+			status, res.platform, res.built, res.installed, res.broken)
+	}
+	return
+}
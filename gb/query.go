@@ -53,7 +53,9 @@ func LoadCWD() (err error) {
 				RunningInGOPATH = gp
 				if CWD != gpsrc {
 					CWD = gpsrc
-					fmt.Printf("Running gb in GOPATH workspace %s\n", CWD)
+					if !MachineReadable {
+						fmt.Printf("Running gb in GOPATH workspace %s\n", CWD)
+					}
 					runningInGOPATH = true
 				}
 			}
@@ -64,7 +66,9 @@ func LoadCWD() (err error) {
 		cfg := ReadConfig(".")
 		if rel, set := cfg.Workspace(); set {
 			CWD = GetAbs(filepath.Join(OSWD, rel), OSWD)
-			fmt.Printf("Running gb in workspace %s\n", CWD)
+			if !MachineReadable {
+				fmt.Printf("Running gb in workspace %s\n", CWD)
+			}
 		}
 	}
 	os.Chdir(CWD)
@@ -118,15 +122,30 @@ func LoadEnvs() bool {
 			}
 
 			GOPATH_SRCROOTS = append(GOPATH_SRCROOTS, gpsrc)
-			objdst := filepath.Join(gp, "pkg", fmt.Sprintf("%s_%s", GOOS, GOARCH))
-			GOPATH_OBJDSTS = append(GOPATH_OBJDSTS, objdst)
-			GOPATH_CFLAGS = append(GOPATH_CFLAGS, "-I", objdst)
-			GOPATH_LDFLAGS = append(GOPATH_LDFLAGS, "-L", objdst)
-
-			os.MkdirAll(objdst, 0755)
 		}
 	}
 
+	LoadPlatformEnvs()
+
+	RunningInGOROOT = HasPathPrefix(CWD, filepath.Join(GOROOT, "src"))
+
+	return true
+}
+
+// LoadPlatformEnvs sets up everything that depends on GOOS and GOARCH.
+func LoadPlatformEnvs() {
+	GOPATH_OBJDSTS, GOPATH_CFLAGS, GOPATH_LDFLAGS = nil, nil, nil
+	for _, gp := range GOPATHS {
+		objdst := filepath.Join(gp, "pkg", fmt.Sprintf("%s_%s", GOOS, GOARCH))
+		GOPATH_OBJDSTS = append(GOPATH_OBJDSTS, objdst)
+		GOPATH_CFLAGS = append(GOPATH_CFLAGS, "-I", objdst)
+		GOPATH_LDFLAGS = append(GOPATH_LDFLAGS, "-L", objdst)
+
+		os.MkdirAll(objdst, 0755)
+	}
+
+	GCFLAGS, GLDFLAGS = nil, nil
+
 	gcFlagsStr, gldFlagsStr := os.Getenv("GCFLAGS"), os.Getenv("GB_GLDFLAGS")
 	if gcFlagsStr != "" {
 		GCFLAGS = append(GCFLAGS, strings.Fields(gcFlagsStr)...)
@@ -137,13 +156,17 @@ func LoadEnvs() bool {
 
 	GCFLAGS = append(GCFLAGS, GOPATH_CFLAGS...)
 	GLDFLAGS = append(GLDFLAGS, GOPATH_LDFLAGS...)
+}
 
-	RunningInGOROOT = HasPathPrefix(CWD, filepath.Join(GOROOT, "src"))
-
-	return true
+// PlatformDir is the directory name used for the current GOOS and GOARCH.
+func PlatformDir() (dir string) {
+	return GOOS + "_" + GOARCH
 }
 
 func GetBuildDirPkg() (dir string) {
+	if len(Platforms) != 0 {
+		return filepath.Join(ObjDir, PlatformDir())
+	}
 	return ObjDir
 }
 
@@ -159,14 +182,24 @@ func GetInstallDirPkg() (dir string) {
 }
 
 func GetBuildDirCmd() (dir string) {
+	if len(Platforms) != 0 {
+		return filepath.Join(BinDir, PlatformDir())
+	}
 	return BinDir
 }
 
 func GetInstallDirCmd() (dir string) {
 	if GOPATH_SINGLE != "" {
-		return filepath.Join(GOPATH_SINGLE, "bin")
+		dir = filepath.Join(GOPATH_SINGLE, "bin")
+	} else {
+		dir = GOBIN
 	}
-	return GOBIN
+	// with --platforms, cross-compiled cmds go where they can't be
+	// mistaken for native ones
+	if len(Platforms) != 0 && (GOOS != runtime.GOOS || GOARCH != runtime.GOARCH) {
+		dir = filepath.Join(dir, PlatformDir())
+	}
+	return
 }
 
 func ArchChar() (c string) {
@@ -0,0 +1,179 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+Import paths on hosts that go get does not know about can be made
+goinstallable with a gb.remotes file in the workspace root. Each line
+gives a regular expression for the import paths, the version control
+system they are kept in and the URL to clone them from:
+
+	^(git\.example\.com/[a-z0-9_.\-]+)(/.*)?$ git ssh://git@git.example.com/$1.git
+
+The first group of the expression (or the one named "root") is the import
+path of the repository's root, which is cloned into GOPATH/src/<root>.
+The URL may refer to the groups as $1, ${1} or ${name}. Lines that are
+empty or start with # are ignored.
+
+With -g, gb clones such a package itself before installing it with go
+get, and with -G it updates the clone rather than leaving it to go get -u.
+*/
+
+const RemotesFileName = "gb.remotes"
+
+type Remote struct {
+	Pattern *regexp.Regexp
+	VCS     *VCS
+	URL     string
+}
+
+var remotes []*Remote
+var remotesOnce sync.Once
+
+// ParseRemotes reads the remotes in r, which came from the file name.
+func ParseRemotes(r io.Reader, name string) (remotes []*Remote, err error) {
+	br := bufio.NewReader(r)
+	for lineno := 1; ; lineno++ {
+		var line string
+		line, err = br.ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) != 0 && !strings.HasPrefix(fields[0], "#") {
+			if len(fields) != 3 {
+				err = errors.New(fmt.Sprintf("%s:%d: expected a pattern, a version control system and a URL", name, lineno))
+				return
+			}
+			remote := &Remote{URL: fields[2]}
+			if remote.Pattern, err = regexp.Compile(fields[0]); err != nil {
+				err = errors.New(fmt.Sprintf("%s:%d: %v", name, lineno, err))
+				return
+			}
+			if remote.VCS = LookupVCS(fields[1]); remote.VCS == nil {
+				err = errors.New(fmt.Sprintf("%s:%d: unknown version control system %q", name, lineno, fields[1]))
+				return
+			}
+			remotes = append(remotes, remote)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// GetRemotes returns the remotes in the workspace's gb.remotes.
+func GetRemotes() []*Remote {
+	remotesOnce.Do(func() {
+		fpath := filepath.Join(CWD, RemotesFileName)
+		fin, err := os.Open(fpath)
+		if err != nil {
+			return
+		}
+		defer fin.Close()
+		if remotes, err = ParseRemotes(fin, fpath); err != nil {
+			ErrLog.Printf("%v\n", err)
+		}
+	})
+	return remotes
+}
+
+// Match returns the repository root and clone URL for target, if this
+// remote is for it.
+func (this *Remote) Match(target string) (root, url string, ok bool) {
+	m := this.Pattern.FindStringSubmatchIndex(target)
+	if m == nil {
+		return
+	}
+	group := 0
+	if this.Pattern.NumSubexp() >= 1 {
+		group = 1
+	}
+	for i, name := range this.Pattern.SubexpNames() {
+		if name == "root" {
+			group = i
+		}
+	}
+	if m[2*group] == -1 {
+		return
+	}
+	root = target[m[2*group]:m[2*group+1]]
+	url = string(this.Pattern.ExpandString(nil, this.URL, target, m))
+	ok = true
+	return
+}
+
+// FindRemote returns the remote that target matches in gb.remotes.
+func FindRemote(target string) (remote *Remote, root, url string) {
+	target = strings.Trim(target, "\"")
+	for _, r := range GetRemotes() {
+		var ok bool
+		if root, url, ok = r.Match(target); ok {
+			remote = r
+			return
+		}
+	}
+	return
+}
+
+// FetchRemote clones the repository for target into GOPATH, or with
+// update brings the clone up to date, and then does the same for the
+// packages it imports that gb.remotes is for, since go get cannot.
+func FetchRemote(target string, update bool, fetched map[string]bool) (err error) {
+	remote, root, url := FindRemote(target)
+	if remote == nil || fetched[root] {
+		return
+	}
+	fetched[root] = true
+
+	if dir, inGOPATH := FindInGOPATH(root); inGOPATH {
+		if update {
+			fmt.Printf("Updating \"%s\" from %s\n", root, url)
+			err = remote.VCS.UpdateCheckout(dir)
+		}
+	} else if GOPATH_SINGLE == "" {
+		err = errors.New(fmt.Sprintf("cannot fetch \"%s\" without a GOPATH", target))
+	} else {
+		fmt.Printf("Fetching \"%s\" from %s\n", root, url)
+		err = remote.VCS.CloneInto(url, filepath.Join(GOPATH_SINGLE, "src", filepath.FromSlash(root)))
+	}
+	if err != nil {
+		err = errors.New(fmt.Sprintf("could not fetch \"%s\" from %s: %v", root, url, err))
+		return
+	}
+
+	dir, _ := FindInGOPATH(strings.Trim(target, "\""))
+	for _, dep := range RemoteImports(dir) {
+		if err = FetchRemote(dep, update, fetched); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -16,12 +16,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var MakeCMD,
@@ -88,8 +92,38 @@ func SplitArgs(args []string) (sargs []string) {
 }
 
 func RunExternalDump(cmd, wd string, argv []string, dump *os.File) (err error) {
+	return RunExternalTo(cmd, wd, argv, dump, os.Stderr)
+}
+
+// RunExternalTo runs cmd with its stdout and stderr going to the given
+// writers, rather than gb's own.
+func RunExternalTo(cmd, wd string, argv []string, stdout, stderr io.Writer) (err error) {
+	return RunExternalTimeout(cmd, wd, argv, stdout, stderr, 0)
+}
+
+// how long a command has to exit after being sent SIGQUIT
+var QuitGracePeriod = 5 * time.Second
+
+// RunExternalTimeout is RunExternalTo, except that if timeout is not 0 and
+// cmd runs for longer, it is sent SIGQUIT (so that a Go program dumps its
+// goroutines to stderr) and then killed if it has not exited within
+// QuitGracePeriod.
+func RunExternalTimeout(cmd, wd string, argv []string, stdout, stderr io.Writer, timeout time.Duration) (err error) {
 	argv = SplitArgs(argv)
 
+	// where the command line is echoed with -v
+	var console io.Writer = os.Stdout
+	if stdout == stderr {
+		// when stderr is also logged, the two are copied separately
+		shared := &syncWriter{w: stdout}
+		stdout, stderr = shared, shared
+		// everything about the command goes wherever its output does,
+		// such as a test's buffered output with -p
+		console = shared
+	}
+
+	origCmd := cmd
+
 	if strings.Index(cmd, " ") != -1 {
 		cmds := strings.Fields(cmd)
 		argv = append(cmds[1:], argv...)
@@ -100,17 +134,56 @@ func RunExternalDump(cmd, wd string, argv []string, dump *os.File) (err error) {
 
 	if Verbose {
 		basecmd := filepath.Base(cmd)
-		fmt.Printf("%s\n", append([]string{basecmd}, argv...))
+		fmt.Fprintf(console, "%s\n", append([]string{basecmd}, argv...))
 	}
 
 	c := exec.Command(cmd, argv...)
 	c.Dir = wd
 	c.Env = os.Environ()
 
-	c.Stdout = dump
-	c.Stderr = os.Stderr
+	c.Stdout = stdout
+	c.Stderr = stderr
 
-	err = c.Run()
+	var logged bytes.Buffer
+	if buildLog != nil {
+		c.Stderr = io.MultiWriter(stderr, &logged)
+	}
+
+	start := time.Now()
+	timedOut := false
+	if timeout == 0 {
+		err = c.Run()
+	} else if err = c.Start(); err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(timeout):
+			timedOut = true
+			fmt.Fprintf(stderr, "*** timed out after %v; sending SIGQUIT\n", timeout)
+			if c.Process.Signal(syscall.SIGQUIT) != nil {
+				c.Process.Kill()
+			}
+			select {
+			case err = <-done:
+			case <-time.After(QuitGracePeriod):
+				fmt.Fprintf(stderr, "*** still running after SIGQUIT; killing it\n")
+				c.Process.Kill()
+				err = <-done
+			}
+		}
+	}
+	duration := time.Since(start)
+
+	exit := 0
+	if c.ProcessState != nil {
+		exit = c.ProcessState.ExitCode()
+	} else if err != nil {
+		exit = -1
+	}
+	LogExternal(origCmd, wd, append([]string{cmd}, argv...), exit, logged.String(), start, duration)
 
 	if wmsg, ok := err.(*exec.ExitError); ok {
 		if !wmsg.Success() {
@@ -119,6 +192,9 @@ func RunExternalDump(cmd, wd string, argv []string, dump *os.File) (err error) {
 			err = nil
 		}
 	}
+	if timedOut {
+		err = errors.New(fmt.Sprintf("%v: timed out after %v\n", argv, timeout))
+	}
 	return
 }
 func RunExternal(cmd, wd string, argv []string) (err error) {
@@ -0,0 +1,168 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+What gb learns from parsing a source file is kept in gb.scancache, in the
+workspace root, along with the file's size and modification time. As long
+as those have not changed, the file is not parsed again. The cache holds
+only what is in the file itself (the package name, target comment,
+imports, test functions, #cgo lines and +build lines), so the flags and
+platform gb runs with are still applied each time.
+
+--rescan ignores whatever is in the cache and replaces it.
+*/
+
+const ScanCacheName = "gb.scancache"
+
+// bumped whenever the contents of SourceInfo change
+const ScanCacheVersion = 2
+
+// set by --rescan
+var ForceRescan bool
+
+// SourceInfo is everything GetDeps needs from a parsed source file.
+type SourceInfo struct {
+	Size       int64
+	ModTime    int64
+	ScanFuncs  bool // whether Funcs was filled in
+	Name       string
+	Target     string            `json:",omitempty"`
+	Deps       []string          `json:",omitempty"`
+	Funcs      []string          `json:",omitempty"`
+	Outputs    map[string]string `json:",omitempty"`
+	CGoLines   []string          `json:",omitempty"`
+	BuildLines []string          `json:",omitempty"`
+}
+
+type scanCacheFile struct {
+	Version int
+	Files   map[string]*SourceInfo
+}
+
+var scanCache map[string]*SourceInfo
+var scanCacheDirty bool
+var scanCacheLock sync.Mutex
+
+func GetScanCachePath() (p string) {
+	return filepath.Join(CWD, ScanCacheName)
+}
+
+// loadScanCache reads the cache the first time it is needed. A cache that
+// is missing, unreadable or from another version is treated as empty.
+// scanCacheLock must be held.
+func loadScanCache() {
+	if scanCache != nil {
+		return
+	}
+	scanCache = make(map[string]*SourceInfo)
+	if ForceRescan {
+		scanCacheDirty = true
+		return
+	}
+
+	fin, err := os.Open(GetScanCachePath())
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	var cf scanCacheFile
+	if err = json.NewDecoder(fin).Decode(&cf); err != nil || cf.Version != ScanCacheVersion || cf.Files == nil {
+		scanCacheDirty = true
+		return
+	}
+	scanCache = cf.Files
+}
+
+func scanCacheKey(source string) (key string) {
+	key, err := filepath.Abs(source)
+	if err != nil {
+		key = source
+	}
+	return
+}
+
+// LookupSource returns the cached information for source, if the file has
+// the given size and modification time and was scanned at least as
+// thoroughly as scanFuncs asks for.
+func LookupSource(source string, fi os.FileInfo, scanFuncs bool) (info *SourceInfo, ok bool) {
+	scanCacheLock.Lock()
+	defer scanCacheLock.Unlock()
+
+	loadScanCache()
+	info, ok = scanCache[scanCacheKey(source)]
+	if !ok {
+		return
+	}
+	if info.Size != fi.Size() || info.ModTime != fi.ModTime().UnixNano() || (scanFuncs && !info.ScanFuncs) {
+		info, ok = nil, false
+	}
+	return
+}
+
+func StoreSource(source string, fi os.FileInfo, info *SourceInfo) {
+	scanCacheLock.Lock()
+	defer scanCacheLock.Unlock()
+
+	loadScanCache()
+	info.Size = fi.Size()
+	info.ModTime = fi.ModTime().UnixNano()
+	scanCache[scanCacheKey(source)] = info
+	scanCacheDirty = true
+}
+
+// SaveScanCache writes the cache back out if anything was added to it,
+// dropping the entries for files that no longer exist.
+func SaveScanCache() (err error) {
+	scanCacheLock.Lock()
+	defer scanCacheLock.Unlock()
+
+	if !scanCacheDirty {
+		return
+	}
+
+	for key := range scanCache {
+		if _, serr := os.Stat(key); serr != nil {
+			delete(scanCache, key)
+		}
+	}
+
+	var fout *os.File
+	fout, err = os.Create(GetScanCachePath())
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+
+	cf := scanCacheFile{
+		Version: ScanCacheVersion,
+		Files:   scanCache,
+	}
+	if err = json.NewEncoder(fout).Encode(cf); err != nil {
+		return
+	}
+	scanCacheDirty = false
+	return
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// ScanRecord is what --json reports about a single target. Field names are
+// part of gb's output format and should not be changed.
+type ScanRecord struct {
+	Target string
+	Dir    string
+	Name   string
+
+	IsCmd      bool
+	IsCGo      bool
+	IsProtobuf bool
+	IsYacc     bool
+
+	IsInGOROOT bool
+	IsInGOPATH string `json:",omitempty"`
+	InTestData string `json:",omitempty"`
+
+	Deps     []string
+	TestDeps []string
+
+	GoSources   []string
+	CGoSources  []string
+	AsmSrcs     []string
+	CSrcs       []string
+	CHeaders    []string
+	ProtoSrcs   []string
+	YaccSrcs    []string
+	TestSources []string
+	DeadSources []string
+
+	ResultPath  string
+	InstallPath string
+
+	NeedsBuild   bool
+	NeedsInstall bool
+}
+
+type ScanDocument struct {
+	Targets []*ScanRecord
+}
+
+func sortedCopy(list []string) (sorted []string) {
+	sorted = append([]string{}, list...)
+	sort.Strings(sorted)
+	return
+}
+
+// unquoteDeps turns the quoted import paths kept in Package.Deps into plain
+// ones. Entries that aren't simple quoted strings, such as the "cgo"-cmd
+// dependency added for cgo source, are passed through untouched.
+func unquoteDeps(deps []string) (plain []string) {
+	plain = []string{}
+	for _, dep := range deps {
+		if uq, err := strconv.Unquote(dep); err == nil {
+			dep = uq
+		}
+		plain = append(plain, dep)
+	}
+	sort.Strings(plain)
+	return
+}
+
+func (this *Package) ScanRecord() (rec *ScanRecord) {
+	rec = &ScanRecord{
+		Target:       this.Target,
+		Dir:          this.Dir,
+		Name:         this.Name,
+		IsCmd:        this.IsCmd,
+		IsCGo:        this.IsCGo,
+		IsProtobuf:   this.IsProtobuf,
+		IsYacc:       this.IsYacc,
+		IsInGOROOT:   this.IsInGOROOT,
+		IsInGOPATH:   this.IsInGOPATH,
+		InTestData:   this.InTestData,
+		Deps:         unquoteDeps(this.Deps),
+		TestDeps:     unquoteDeps(this.TestDeps),
+		GoSources:    sortedCopy(this.PkgSrc[this.Name]),
+		CGoSources:   sortedCopy(this.CGoSources),
+		AsmSrcs:      sortedCopy(this.AsmSrcs),
+		CSrcs:        sortedCopy(this.CSrcs),
+		CHeaders:     sortedCopy(this.CHeaders),
+		ProtoSrcs:    sortedCopy(this.ProtoSrcs),
+		YaccSrcs:     sortedCopy(this.YaccSrcs),
+		TestSources:  sortedCopy(this.TestSources),
+		DeadSources:  sortedCopy(this.DeadSources),
+		ResultPath:   this.ResultPath,
+		InstallPath:  this.InstallPath,
+		NeedsBuild:   this.NeedsBuild,
+		NeedsInstall: this.NeedsInstall,
+	}
+	return
+}
+
+// CollectScan gathers the records for the same targets, in the same
+// circumstances, that PrintScan would print.
+func (this *Package) CollectScan(doc *ScanDocument) {
+	if this.IsCmd && !DoCmds {
+		return
+	}
+	if !this.IsCmd && !DoPkgs {
+		return
+	}
+
+	if this.scanned {
+		return
+	}
+	this.scanned = true
+
+	for _, pkg := range this.DepPkgs {
+		pkg.CollectScan(doc)
+	}
+
+	doc.Targets = append(doc.Targets, this.ScanRecord())
+}
+
+type byRecordTarget []*ScanRecord
+
+func (b byRecordTarget) Len() int      { return len(b) }
+func (b byRecordTarget) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRecordTarget) Less(i, j int) bool {
+	if b[i].Target == b[j].Target {
+		return b[i].Dir < b[j].Dir
+	}
+	return b[i].Target < b[j].Target
+}
+
+func WriteScanJSON(pkgs []*Package) (err error) {
+	doc := &ScanDocument{
+		Targets: []*ScanRecord{},
+	}
+	for _, pkg := range pkgs {
+		pkg.CollectScan(doc)
+	}
+	sort.Sort(byRecordTarget(doc.Targets))
+
+	var data []byte
+	data, err = json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	_, err = os.Stdout.Write(data)
+	return
+}
@@ -0,0 +1,170 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+type buildNode struct {
+	pkg        *Package
+	waiting    int // the number of deps that have not finished building
+	dependents []*buildNode
+	failed     bool
+	err        error
+}
+
+type byTarget []*buildNode
+
+func (b byTarget) Len() int      { return len(b) }
+func (b byTarget) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byTarget) Less(i, j int) bool {
+	if b[i].pkg.Target == b[j].pkg.Target {
+		return b[i].pkg.Dir < b[j].pkg.Dir
+	}
+	return b[i].pkg.Target < b[j].pkg.Target
+}
+
+/*
+A BuildScheduler walks the DepPkgs graph of a set of targets from the
+leaves up, handing each target to one of a fixed number of workers as soon
+as everything it imports has been built. Targets that are ready at the same
+time are started in order of their target names. When a target fails, none
+of the targets that depend on it are started.
+*/
+type BuildScheduler struct {
+	Jobs  int
+	nodes map[*Package]*buildNode
+	ready []*buildNode
+}
+
+func NewBuildScheduler(jobs int) (this *BuildScheduler) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	this = &BuildScheduler{
+		Jobs:  jobs,
+		nodes: make(map[*Package]*buildNode),
+	}
+	return
+}
+
+func (this *BuildScheduler) add(pkg *Package) (n *buildNode) {
+	if n, ok := this.nodes[pkg]; ok {
+		return n
+	}
+	n = &buildNode{pkg: pkg}
+	this.nodes[pkg] = n
+	for _, dep := range pkg.DepPkgs {
+		dn := this.add(dep)
+		dn.dependents = append(dn.dependents, n)
+		n.waiting++
+	}
+	return
+}
+
+func (this *BuildScheduler) push(n *buildNode) {
+	this.ready = append(this.ready, n)
+	sort.Sort(byTarget(this.ready))
+}
+
+func (this *BuildScheduler) pop() (n *buildNode) {
+	n = this.ready[0]
+	this.ready = this.ready[1:]
+	return
+}
+
+// fail marks everything downstream of n as unbuildable, and returns how
+// many targets will now never be started.
+func (this *BuildScheduler) fail(n *buildNode) (count int) {
+	for _, d := range n.dependents {
+		if d.failed {
+			continue
+		}
+		d.failed = true
+		d.pkg.depsFailed()
+		count += 1 + this.fail(d)
+	}
+	return
+}
+
+// Build brings pkgs and everything they import up to date. The error
+// returned is that of the first target, by name, that failed.
+func (this *BuildScheduler) Build(pkgs []*Package) (err error) {
+	for _, pkg := range pkgs {
+		this.add(pkg)
+	}
+	for _, n := range this.nodes {
+		if n.waiting == 0 {
+			this.push(n)
+		}
+	}
+
+	jobs := make(chan *buildNode)
+	results := make(chan *buildNode)
+	for i := 0; i < this.Jobs; i++ {
+		go func() {
+			for n := range jobs {
+				n.err = n.pkg.build(false)
+				results <- n
+			}
+		}()
+	}
+
+	var failures []*buildNode
+	remaining := len(this.nodes)
+	running := 0
+	for remaining > 0 {
+		for running < this.Jobs && len(this.ready) > 0 {
+			jobs <- this.pop()
+			running++
+		}
+		if running == 0 {
+			// can only happen with a cycle, which RunGB rules out
+			err = errors.New(fmt.Sprintf("%d targets could not be scheduled", remaining))
+			break
+		}
+
+		n := <-results
+		running--
+		remaining--
+
+		if n.err != nil {
+			failures = append(failures, n)
+			remaining -= this.fail(n)
+			continue
+		}
+		for _, d := range n.dependents {
+			if d.failed {
+				continue
+			}
+			d.waiting--
+			if d.waiting == 0 {
+				this.push(d)
+			}
+		}
+	}
+	close(jobs)
+
+	if len(failures) != 0 && err == nil {
+		sort.Sort(byTarget(failures))
+		err = failures[0].err
+	}
+	return
+}
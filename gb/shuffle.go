@@ -0,0 +1,77 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+With --test-shuffle, the tests of each package are listed in _testmain.go
+in an order chosen by a seed, rather than the order they appear in the
+source, so tests that only pass after some other test has run show up.
+The seed is printed by gb and by the test binary; giving it back with
+--test-shuffle=SEED lists the tests in the same order again, so long as
+the set of tests has not changed.
+*/
+
+// set by --test-shuffle
+var TestShuffle bool
+var TestShuffleSeed int64
+
+// PickShuffleSeed chooses a seed, unless one was given.
+func PickShuffleSeed(given string) (err error) {
+	TestShuffle = true
+	if given == "" {
+		TestShuffleSeed = time.Now().UnixNano()
+		return
+	}
+	TestShuffleSeed, err = strconv.ParseInt(given, 10, 64)
+	return
+}
+
+// ShuffleTests returns names in an order that depends only on seed and the
+// set of names, not the order they were given in.
+func ShuffleTests(names []string, seed int64) (shuffled []string) {
+	shuffled = append([]string{}, names...)
+	sort.Strings(shuffled)
+	r := rand.New(rand.NewSource(seed))
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return
+}
+
+type byPkgName []*TestPkg
+
+func (b byPkgName) Len() int           { return len(b) }
+func (b byPkgName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPkgName) Less(i, j int) bool { return b[i].PkgName < b[j].PkgName }
+
+// Shuffle reorders the tests of each package in the suite.
+func (this *TestSuite) Shuffle(seed int64) {
+	sort.Sort(byPkgName(this.TestPkgs))
+	for _, tpkg := range this.TestPkgs {
+		tpkg.TestFuncs = ShuffleTests(tpkg.TestFuncs, seed)
+	}
+	this.Shuffled = true
+	this.ShuffleSeed = seed
+}
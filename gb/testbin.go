@@ -0,0 +1,162 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+With --test-compile-only, each target's test binary is linked but not run.
+It is left in _test/_testmain, and copied to _bin/tests/<target>.test (or
+<target>-cmd.test, for a cmd). _bin/tests/manifest.json lists, for each
+target, where its binary is and the directory it must be run in, both
+relative to the workspace root, along with the arguments it would have
+been given, so that the tests can be run on another machine with a copy
+of the workspace.
+*/
+
+const TestManifestName = "manifest.json"
+
+// set by --test-compile-only
+var TestCompileOnly bool
+
+type TestManifestEntry struct {
+	Target string
+	Cmd    bool `json:",omitempty"`
+	Binary string
+	Dir    string
+	Args   []string `json:",omitempty"`
+}
+
+type byEntryTarget []*TestManifestEntry
+
+func (b byEntryTarget) Len() int      { return len(b) }
+func (b byEntryTarget) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byEntryTarget) Less(i, j int) bool {
+	if b[i].Target != b[j].Target {
+		return b[i].Target < b[j].Target
+	}
+	return !b[i].Cmd && b[j].Cmd
+}
+
+var testManifest []*TestManifestEntry
+var testManifestLock sync.Mutex
+
+func GetTestBinDir() (dir string) {
+	return filepath.Join(GetBuildDirCmd(), "tests")
+}
+
+func (this *Package) TestBinaryPath() (fpath string) {
+	name := this.Target
+	if this.IsCmd {
+		name += "-cmd"
+	}
+	name += ".test"
+	if GOOS == "windows" {
+		name += ".exe"
+	}
+	fpath = filepath.Join(GetTestBinDir(), filepath.FromSlash(name))
+	return
+}
+
+// SaveTestBinary copies the test binary linked for this target to its
+// place in _bin/tests, and adds it to the manifest.
+func (this *Package) SaveTestBinary(testBinary string, out io.Writer) (err error) {
+	dst := this.TestBinaryPath()
+	fmt.Fprintf(out, " Copying test binary to %s\n", dst)
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+
+	var fin, fout *os.File
+	fin, err = os.Open(testBinary)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+	fout, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+	if _, err = io.Copy(fout, fin); err != nil {
+		return
+	}
+
+	entry := &TestManifestEntry{
+		Target: this.Target,
+		Cmd:    this.IsCmd,
+		Binary: filepath.ToSlash(dst),
+		Dir:    filepath.ToSlash(this.Dir),
+		Args:   TestArgs,
+	}
+
+	testManifestLock.Lock()
+	defer testManifestLock.Unlock()
+	// replaces the entry from an earlier build, eg with --watch
+	for i, old := range testManifest {
+		if old.Target == entry.Target && old.Cmd == entry.Cmd {
+			testManifest[i] = entry
+			return
+		}
+	}
+	testManifest = append(testManifest, entry)
+	return
+}
+
+// WriteTestManifest lists the test binaries saved by this run in
+// _bin/tests/manifest.json.
+func WriteTestManifest() (err error) {
+	testManifestLock.Lock()
+	defer testManifestLock.Unlock()
+
+	if len(testManifest) == 0 {
+		return
+	}
+	sort.Sort(byEntryTarget(testManifest))
+
+	fpath := filepath.Join(GetTestBinDir(), TestManifestName)
+	if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return
+	}
+	var data []byte
+	data, err = json.MarshalIndent(testManifest, "", "  ")
+	if err != nil {
+		return
+	}
+	var fout *os.File
+	fout, err = os.Create(fpath)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+	if _, err = fout.Write(data); err != nil {
+		return
+	}
+	if _, err = fmt.Fprintln(fout); err != nil {
+		return
+	}
+	fmt.Printf("Wrote test manifest to %s\n", fpath)
+	return
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+When a target's tests pass, what they printed is kept in
+_obj/gb.testcache, under a digest of everything the result could depend
+on: the target's own digest, its test source, the digests of the
+workspace targets its tests import and the archives of the others, the
+contents of its testdata directory, the arguments given to the test
+binary and the environment it runs in. While that digest stays the same,
+the tests are not run again, and their output is printed with "(cached)".
+
+Tests run with --cover or --junit, or with make, are never cached, and
+--retest runs every test regardless.
+*/
+
+const TestCacheName = "gb.testcache"
+
+// set by --retest
+var ForceRetest bool
+
+func GetTestCacheDir() (dir string) {
+	return filepath.Join(GetBuildDirPkg(), TestCacheName)
+}
+
+func (this *Package) testCachePath() (fpath string) {
+	name := strings.Replace(this.Target, "/", "_", -1)
+	if this.IsCmd {
+		name += "-cmd"
+	}
+	fpath = filepath.Join(GetTestCacheDir(), name)
+	return
+}
+
+// hashTree hashes the names, sizes and modification times of everything
+// under dir.
+func hashTree(h io.Writer, dir string) {
+	filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, fpath)
+		fmt.Fprintf(h, "%s %d %d\n", filepath.ToSlash(rel), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+}
+
+func (this *Package) ComputeTestDigest() (digest string) {
+	h := sha1.New()
+
+	fmt.Fprintf(h, "build %s\n", this.ComputeDigest())
+
+	srcs := append([]string{}, this.TestSources...)
+	sort.Strings(srcs)
+	for _, src := range srcs {
+		fmt.Fprintf(h, "test src %s\n", src)
+		if err := hashFile(h, path.Join(this.Dir, src)); err != nil {
+			fmt.Fprintf(h, "missing\n")
+		}
+	}
+
+	deps := append([]*Package{}, this.TestDepPkgs...)
+	sort.Sort(byPkgTarget(deps))
+	for _, pkg := range deps {
+		fmt.Fprintf(h, "test dep %s %s\n", pkg.Target, pkg.ComputeDigest())
+	}
+
+	var archives []string
+	for _, dep := range this.TestDeps {
+		if _, ok := Packages[dep]; ok {
+			continue
+		}
+		if exists, _ := PkgExistsInGOROOT(dep); exists {
+			archives = append(archives, GOROOTArchive(dep))
+		} else {
+			archives = append(archives, InstalledArchive(dep))
+		}
+	}
+	sort.Strings(archives)
+	for _, archive := range archives {
+		fmt.Fprintf(h, "test archive %s %s\n", archive, ArchiveDigest(archive))
+	}
+
+	fmt.Fprintf(h, "testdata\n")
+	hashTree(h, path.Join(this.Dir, "testdata"))
+
+	fmt.Fprintf(h, "args %q\n", TestArgs)
+	if TestShuffle {
+		fmt.Fprintf(h, "shuffle %d\n", TestShuffleSeed)
+	}
+	var tags []string
+	for tag := range BuildTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(h, "tags %q\n", tags)
+	for _, name := range []string{"GOROOT", "GOPATH", "GOOS", "GOARCH", "CGO_ENABLED", "PATH", "HOME", "TMPDIR"} {
+		fmt.Fprintf(h, "env %s=%s\n", name, os.Getenv(name))
+	}
+
+	digest = fmt.Sprintf("%x", h.Sum(nil))
+	return
+}
+
+// CachedTestOutput returns what this target's tests printed the last time
+// they passed, if that was with the given digest.
+func (this *Package) CachedTestOutput(digest string) (output []byte, ok bool) {
+	fin, err := os.Open(this.testCachePath())
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	br := bufio.NewReader(fin)
+	line, err := br.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != digest {
+		return
+	}
+	output, err = ioutil.ReadAll(br)
+	ok = err == nil
+	return
+}
+
+func (this *Package) CacheTestOutput(digest string, output []byte) (err error) {
+	fpath := this.testCachePath()
+	if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return
+	}
+	var fout *os.File
+	fout, err = os.Create(fpath)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+	if _, err = fmt.Fprintf(fout, "%s\n", digest); err != nil {
+		return
+	}
+	_, err = fout.Write(output)
+	return
+}
+
+func (this *Package) ForgetTestOutput() {
+	os.Remove(this.testCachePath())
+}
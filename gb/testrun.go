@@ -0,0 +1,149 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+With -p or -j, the tests of up to Jobs targets are built and run at once.
+Each target is tested in its own _test directory, and everything its test
+prints is held back until it is done and then printed in one piece, so
+that the output of different targets is never interleaved. Every target is
+tested even when some fail, and the result of each one is listed at the
+end. With --bench, targets are tested one at a time anyway, so that the
+benchmarks of one are not slowed down by the tests of another.
+*/
+
+type TestResult struct {
+	Pkg      *Package
+	Err      error
+	Duration time.Duration
+}
+
+type byResultTarget []*TestResult
+
+func (b byResultTarget) Len() int      { return len(b) }
+func (b byResultTarget) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byResultTarget) Less(i, j int) bool {
+	return byPkgTarget{b[i].Pkg, b[j].Pkg}.Less(0, 1)
+}
+
+// syncWriter lets a test binary's stdout and stderr share a buffer.
+type syncWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (this *syncWriter) Write(p []byte) (n int, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.w.Write(p)
+}
+
+var testOutputLock sync.Mutex
+
+func runTest(pkg *Package, out io.Writer) (result *TestResult) {
+	result = &TestResult{Pkg: pkg}
+	start := time.Now()
+	result.Err = pkg.Test(out)
+	result.Duration = time.Since(start)
+	return
+}
+
+// RunTests tests each of pkgs, jobs of them at a time, and returns the
+// results in order of target.
+func RunTests(pkgs []*Package, jobs int) (results []*TestResult) {
+	if jobs <= 1 {
+		for _, pkg := range pkgs {
+			results = append(results, runTest(pkg, os.Stdout))
+		}
+		sort.Sort(byResultTarget(results))
+		return
+	}
+
+	next := make(chan *Package)
+	done := make(chan *TestResult)
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for pkg := range next {
+				var buf bytes.Buffer
+				result := runTest(pkg, &syncWriter{w: &buf})
+
+				testOutputLock.Lock()
+				os.Stdout.Write(buf.Bytes())
+				testOutputLock.Unlock()
+
+				done <- result
+			}
+		}()
+	}
+	go func() {
+		for _, pkg := range pkgs {
+			next <- pkg
+		}
+		close(next)
+	}()
+
+	for _ = range pkgs {
+		results = append(results, <-done)
+	}
+	sort.Sort(byResultTarget(results))
+	return
+}
+
+// PrintTestResults lists how each target's tests went, and returns an
+// error if any of them failed.
+func PrintTestResults(results []*TestResult) (err error) {
+	if len(results) == 0 {
+		return
+	}
+
+	failed := 0
+	fmt.Printf("Test results:\n")
+	for _, result := range results {
+		status := "ok"
+		if TestCompileOnly {
+			status = "built"
+		}
+		if result.Err != nil {
+			status = "FAIL"
+			failed++
+		} else if result.Pkg.TestSkipped {
+			status = "skip"
+		}
+		if result.Pkg.TestCached {
+			fmt.Printf(" %-5s \"%s\" (cached)\n", status, result.Pkg.Target)
+		} else {
+			fmt.Printf(" %-5s \"%s\" (%.2fs)\n", status, result.Pkg.Target, result.Duration.Seconds())
+		}
+	}
+
+	if failed != 0 {
+		ReturnFailCode = true
+		err = errors.New(fmt.Sprintf("%d of %d tested targets failed", failed, len(results)))
+	}
+	return
+}
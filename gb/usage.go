@@ -32,10 +32,11 @@ Options:
  -G use "goinstall -clean -u" when possible
  -h print this usage text
  -i install
+ -j N build or test at most N targets at once (implies -p)
  -L scan and list targets and their source files
  -m use makefiles, when possible
  -N nuke
- -p build packages in parallel, when possible
+ -p build packages and run tests in parallel, when possible
  -P build/clean/install only packages
  -R update dependencies in $GOROOT/src
  -s scan and list targets without building
@@ -46,8 +47,50 @@ Options:
      run gofmt on source files in targeted directories
  --workspace
      create workspace.gb files in all directories
+ --check-deps
+     list unresolved imports by source file, and packages no listed target uses
+ --vendor
+     copy the goinstallable packages the targets import from GOPATH into vendor
+ --locked
+     check out the revisions in gb.lock of goinstalled packages before building
  --make-a-mess
      don't clean up intermediate files
+ --platforms=GOOS/GOARCH,...
+     build everything once for each platform, into _obj/GOOS_GOARCH and
+     _bin/GOOS_GOARCH
+ --rescan
+     ignore gb.scancache and parse every source file again
+ --tags=TAG,...
+     also satisfy these tags in // +build constraints
+ --watch
+     keep running, and rebuild (and retest, with -t) whenever source changes
+ --log=FILE
+     record every external command run, with timings, in FILE
+ --json
+     scan and print targets, their dependencies and source files as JSON
+ --graph
+     print the dependency graph of the listed targets in Graphviz DOT format
+ --cover[=FILE]
+     with -t, report the statement coverage of each target's tests, and write
+     a combined profile to FILE (cover.out in the workspace by default)
+ --bench=REGEX
+     with -t, also run the benchmarks matching REGEX
+ --bench-save=NAME
+     save the ns/op of each benchmark run in gb.bench.NAME
+ --bench-compare=NAME
+     compare the benchmarks run with those in gb.bench.NAME
+ --bench-threshold=PCT
+     with --bench-compare, how much slower counts as a regression (10)
+ --test-timeout=DURATION
+     with -t, stop a target's test binary if it runs longer than DURATION
+ --test-shuffle[=SEED]
+     with -t, run each package's tests in an order chosen by SEED (or at random)
+ --test-compile-only
+     with -t, build the test binaries into _bin/tests instead of running them
+ --retest
+     with -t, run tests even if they passed last time and nothing has changed
+ --junit=DIR
+     with -t, write the results of each target's tests to DIR as JUnit XML
  --testargs
      all arguments following --testargs are passed to the test binary
 `
@@ -0,0 +1,159 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VCS describes how gb asks a version control system about a checkout.
+// In the argument lists, {rev} stands for a revision, {url} for where a
+// repository is cloned from and {dir} for where it is cloned to.
+type VCS struct {
+	Name     string
+	Dir      string // the metadata directory at the root of a checkout
+	Clone    []string
+	Pull     []string // brings in and checks out the latest revision
+	Revision []string
+	Checkout []string
+	Fetch    []string
+}
+
+var VCSList = []*VCS{
+	{
+		Name:     "git",
+		Dir:      ".git",
+		Clone:    []string{"clone", "-q", "{url}", "{dir}"},
+		Pull:     []string{"pull", "-q", "--ff-only"},
+		Revision: []string{"rev-parse", "HEAD"},
+		Checkout: []string{"checkout", "-q", "{rev}"},
+		Fetch:    []string{"fetch", "-q"},
+	},
+	{
+		Name:     "hg",
+		Dir:      ".hg",
+		Clone:    []string{"clone", "-q", "{url}", "{dir}"},
+		Pull:     []string{"pull", "-q", "-u"},
+		Revision: []string{"log", "-r", ".", "--template", "{node}"},
+		Checkout: []string{"update", "-q", "-r", "{rev}"},
+		Fetch:    []string{"pull", "-q"},
+	},
+	{
+		Name:     "bzr",
+		Dir:      ".bzr",
+		Clone:    []string{"branch", "-q", "{url}", "{dir}"},
+		Pull:     []string{"pull", "-q"},
+		Revision: []string{"revno"},
+		Checkout: []string{"update", "-q", "-r", "{rev}"},
+		Fetch:    []string{"pull", "-q"},
+	},
+	{
+		Name:     "svn",
+		Dir:      ".svn",
+		Clone:    []string{"checkout", "-q", "{url}", "{dir}"},
+		Pull:     []string{"update", "-q"},
+		Revision: []string{"info", "--show-item", "revision"},
+		Checkout: []string{"update", "-q", "-r", "{rev}"},
+	},
+}
+
+func LookupVCS(name string) (vcs *VCS) {
+	for _, v := range VCSList {
+		if v.Name == name {
+			return v
+		}
+	}
+	return
+}
+
+// FindCheckout walks up from dir, but not above top, to the root of the
+// checkout it is in.
+func FindCheckout(dir, top string) (root string, vcs *VCS, err error) {
+	top = filepath.Clean(top)
+	for root = filepath.Clean(dir); ; root = filepath.Dir(root) {
+		for _, v := range VCSList {
+			if info, serr := os.Stat(filepath.Join(root, v.Dir)); serr == nil && info.IsDir() {
+				vcs = v
+				return
+			}
+		}
+		if root == top || !HasPathPrefix(root, top) || filepath.Dir(root) == root {
+			break
+		}
+	}
+	err = errors.New(fmt.Sprintf("%s is not in a git, hg, bzr or svn checkout", dir))
+	return
+}
+
+// args fills in the arguments, given pairs like "{rev}", rev.
+func (this *VCS) args(args []string, vars ...string) (argv []string) {
+	r := strings.NewReplacer(vars...)
+	for _, arg := range args {
+		argv = append(argv, r.Replace(arg))
+	}
+	return
+}
+
+func (this *VCS) run(root string, args []string, vars ...string) (output string, err error) {
+	var out bytes.Buffer
+	err = RunExternalTo(this.Name, root, this.args(args, vars...), &out, os.Stderr)
+	output = strings.TrimSpace(out.String())
+	return
+}
+
+// CurrentRevision returns the revision that the checkout at root has checked out.
+func (this *VCS) CurrentRevision(root string) (rev string, err error) {
+	rev, err = this.run(root, this.Revision)
+	if err == nil && rev == "" {
+		err = errors.New(fmt.Sprintf("%s reported no revision for %s", this.Name, root))
+	}
+	return
+}
+
+// CheckoutRevision updates the checkout at root to rev, fetching from
+// where it was cloned from if rev is not there yet.
+func (this *VCS) CheckoutRevision(root, rev string) (err error) {
+	if _, err = this.run(root, this.Checkout, "{rev}", rev); err == nil || this.Fetch == nil {
+		return
+	}
+	if _, err = this.run(root, this.Fetch); err != nil {
+		return
+	}
+	_, err = this.run(root, this.Checkout, "{rev}", rev)
+	return
+}
+
+// CloneInto clones the repository at url into dir.
+func (this *VCS) CloneInto(url, dir string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return
+	}
+	_, err = this.run(".", this.Clone, "{url}", url, "{dir}", dir)
+	return
+}
+
+// UpdateCheckout brings the checkout at root up to date with where it was
+// cloned from.
+func (this *VCS) UpdateCheckout(root string) (err error) {
+	_, err = this.run(root, this.Pull)
+	return
+}
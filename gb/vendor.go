@@ -0,0 +1,242 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+With --vendor, every goinstallable package imported by the listed targets
+(and the workspace targets they depend on) is copied from GOPATH into the
+vendor directory at the root of the workspace, as vendor/<import path>.
+The packages those import are vendored as well. With -g, packages missing
+from GOPATH are fetched first, and with -G, they are all updated first.
+
+Packages that were vendored before, which are now workspace targets, are
+copied from GOPATH again, along with anything they have started to import.
+
+When scanning, a directory under vendor gets the target name of its path
+within vendor, so that the vendored packages are built as part of the
+workspace, under the import paths the targets already use.
+*/
+
+const VendorDir = "vendor"
+
+// set by --vendor
+var Vendor bool
+
+// IsVendored reports whether this target was copied into the vendor
+// directory.
+func (this *Package) IsVendored() bool {
+	return !this.IsCmd && HasPathPrefix(GetAbs(this.Dir, CWD), filepath.Join(CWD, VendorDir))
+}
+
+// FindInGOPATH returns the directory holding the source for target.
+func FindInGOPATH(target string) (dir string, found bool) {
+	for _, srcroot := range GOPATH_SRCROOTS {
+		dir = filepath.Join(srcroot, filepath.FromSlash(target))
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// vendorFiles lists the files in dir that belong to its package, leaving
+// out subdirectories, which are packages of their own, and hidden files.
+func vendorFiles(dir string) (names []string, err error) {
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return
+}
+
+// RemoteImports returns the goinstallable packages imported by the
+// non-test source in dir.
+func RemoteImports(dir string) (imports []string) {
+	names, err := vendorFiles(dir)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		_, _, deps, _, _, _, _, derr := GetDeps(filepath.Join(dir, name))
+		if derr != nil {
+			continue
+		}
+		for _, dep := range deps {
+			if IsGoInstallable(dep) && !seen[dep] {
+				seen[dep] = true
+				imports = append(imports, dep)
+			}
+		}
+	}
+	sort.Strings(imports)
+	return
+}
+
+func copyFile(src, dst string, mode os.FileMode) (err error) {
+	var fin, fout *os.File
+	fin, err = os.Open(src)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+	fout, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+	_, err = io.Copy(fout, fin)
+	return
+}
+
+// VendorPackage copies the source of target from srcdir into the vendor
+// directory, replacing what was there, and returns the goinstallable
+// packages it imports.
+func VendorPackage(target, srcdir string) (imports []string, err error) {
+	dstdir := filepath.Join(CWD, VendorDir, filepath.FromSlash(target))
+
+	var names []string
+	if names, err = vendorFiles(srcdir); err != nil {
+		return
+	}
+	if old, oerr := vendorFiles(dstdir); oerr == nil {
+		for _, name := range old {
+			if err = os.Remove(filepath.Join(dstdir, name)); err != nil {
+				return
+			}
+		}
+	}
+	if err = os.MkdirAll(dstdir, 0755); err != nil {
+		return
+	}
+
+	for _, name := range names {
+		src := filepath.Join(srcdir, name)
+		var info os.FileInfo
+		if info, err = os.Stat(src); err != nil {
+			return
+		}
+		if err = copyFile(src, filepath.Join(dstdir, name), info.Mode().Perm()); err != nil {
+			return
+		}
+	}
+	imports = RemoteImports(dstdir)
+	return
+}
+
+// VendorTargets vendors the goinstallable imports of pkgs and of the
+// workspace targets they depend on.
+func VendorTargets(pkgs []*Package) (err error) {
+	gm := make(map[string]bool)
+	visited := make(map[*Package]bool)
+	var collect func(pkg *Package)
+	collect = func(pkg *Package) {
+		if visited[pkg] {
+			return
+		}
+		visited[pkg] = true
+		pkg.CollectGoInstall(gm)
+		for _, dep := range pkg.DepPkgs {
+			// copied before, so vendored again from GOPATH
+			if dep.IsVendored() {
+				gm[dep.ImportKey()] = true
+			}
+			collect(dep)
+		}
+	}
+	for _, pkg := range pkgs {
+		collect(pkg)
+	}
+
+	var queue []string
+	for dep := range gm {
+		queue = append(queue, dep)
+	}
+	sort.Strings(queue)
+
+	vendored := make(map[string]bool)
+	copied := 0
+	for len(queue) != 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		target := strings.Trim(dep, "\"")
+		if vendored[target] {
+			continue
+		}
+		vendored[target] = true
+
+		srcdir, found := FindInGOPATH(target)
+		if GoInstall && (!found || GoInstallUpdate) {
+			GoInstallPkg(dep)
+			srcdir, found = FindInGOPATH(target)
+		}
+		if !found {
+			if _, err2 := os.Stat(filepath.Join(CWD, VendorDir, filepath.FromSlash(target))); err2 == nil {
+				WarnLog.Printf("\"%s\" is not in GOPATH; keeping the vendored copy", target)
+				continue
+			}
+			err = errors.New(fmt.Sprintf("could not find \"%s\" in GOPATH (try -g)", target))
+			return
+		}
+
+		fmt.Printf("Vendoring \"%s\" from %s\n", target, srcdir)
+		var imports []string
+		if imports, err = VendorPackage(target, srcdir); err != nil {
+			err = errors.New(fmt.Sprintf("could not vendor \"%s\": %v", target, err))
+			return
+		}
+		copied++
+		queue = append(queue, imports...)
+	}
+
+	if copied == 1 {
+		fmt.Printf("Vendored 1 package into %s\n", VendorDir)
+	} else {
+		fmt.Printf("Vendored %d packages into %s\n", copied, VendorDir)
+	}
+	return
+}
+
+func TryVendor() (err error) {
+	if Vendor {
+		err = VendorTargets(ListedPkgs)
+	}
+	return
+}
@@ -0,0 +1,280 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how often --watch looks at the source directories
+var WatchInterval = time.Second
+
+/*
+With --watch, gb keeps the scanned Packages around after the first build
+and polls the directory of each one. When a directory changes, only that
+target is scanned again; the targets that import it are re-resolved
+against the new one, and whatever is now out of date among the listed
+targets is rebuilt (and retested, with -t).
+
+Directories that did not hold a target when gb started are not watched.
+*/
+
+// watchedFile reports whether a change to the named file could change how
+// a target is built, as opposed to being something gb wrote itself.
+func watchedFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "#") {
+		return false
+	}
+	switch name {
+	case "gb.cfg", "target.gb", "Makefile", "makefile":
+		return true
+	}
+	if strings.HasSuffix(name, ".pb.go") ||
+		strings.HasSuffix(name, ".y.go") ||
+		strings.HasSuffix(name, ".cgo1.go") ||
+		strings.HasSuffix(name, "_testmain.go") ||
+		strings.HasPrefix(name, "_cgo_") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".go", ".c", ".h", ".s", ".proto", ".y":
+		return true
+	}
+	return false
+}
+
+// DirFingerprint summarizes the names, sizes and modification times of the
+// watched files in dir.
+func DirFingerprint(dir string) (fp string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	var lines []string
+	for _, info := range infos {
+		if info.IsDir() || !watchedFile(info.Name()) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %d", info.Name(), info.Size(), info.ModTime().UnixNano()))
+	}
+	sort.Strings(lines)
+	fp = strings.Join(lines, "\n")
+	return
+}
+
+func watchable(pkg *Package) bool {
+	if pkg.IsInGOROOT && !RunningInGOROOT {
+		return false
+	}
+	if pkg.IsInGOPATH != "" && RunningInGOPATH == "" {
+		return false
+	}
+	return true
+}
+
+// Rescan replaces old with a freshly scanned package from the same
+// directory, and re-resolves everything that imported either one. If the
+// scan fails, say because a file was saved halfway through an edit, old is
+// kept as it was, so that it is tried again on the next change.
+func Rescan(old *Package) (pkg *Package, err error) {
+	oldKey := old.ImportKey()
+	registered := Packages[oldKey] == old
+	if registered {
+		delete(Packages, oldKey)
+	}
+
+	pkg, err = NewPackage(old.scanBase, old.Dir, old.InTestData, ReadConfig(old.Dir))
+	var newKey string
+	if err == nil {
+		newKey = pkg.ImportKey()
+		if dup, exists := Packages[newKey]; exists {
+			err = errors.New(fmt.Sprintf("Duplicate target: %s\n in %s\n in %s", pkg.Target, dup.Dir, pkg.Dir))
+		} else {
+			Packages[newKey] = pkg
+			pkg.Stat()
+			pkg.ResolveDeps()
+		}
+	}
+	if err != nil {
+		pkg = nil
+		if registered {
+			Packages[oldKey] = old
+		}
+		return
+	}
+
+	importsChanged := func(deps []string) bool {
+		for _, dep := range deps {
+			if dep == oldKey || dep == newKey {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range Packages {
+		if p != pkg && (importsChanged(p.Deps) || importsChanged(p.TestDeps)) {
+			p.ResolveDeps()
+		}
+	}
+
+	for i, lp := range ListedPkgs {
+		if lp == old {
+			ListedPkgs[i] = pkg
+			break
+		}
+	}
+	return
+}
+
+// Affected returns changed and every target that imports one of them,
+// directly or not, including through test source.
+func Affected(changed []*Package) (affected map[*Package]bool) {
+	dependents := make(map[*Package][]*Package)
+	for _, p := range Packages {
+		for _, dep := range p.DepPkgs {
+			dependents[dep] = append(dependents[dep], p)
+		}
+		for _, dep := range p.TestDepPkgs {
+			dependents[dep] = append(dependents[dep], p)
+		}
+	}
+
+	affected = make(map[*Package]bool)
+	var mark func(p *Package)
+	mark = func(p *Package) {
+		if affected[p] {
+			return
+		}
+		affected[p] = true
+		for _, d := range dependents[p] {
+			mark(d)
+		}
+	}
+	for _, p := range changed {
+		mark(p)
+	}
+	return
+}
+
+func resetStatus() {
+	PackagesBuilt = 0
+	PackagesCleaned = 0
+	PackagesInstalled = 0
+	BrokenPackages = 0
+	BrokenMsg = nil
+}
+
+func WatchForChanges() (err error) {
+	fingerprints := make(map[*Package]string)
+	for _, pkg := range Packages {
+		if watchable(pkg) {
+			fingerprints[pkg] = DirFingerprint(pkg.Dir)
+		}
+	}
+
+	fmt.Printf("Watching %d targets for changes\n", len(fingerprints))
+
+	for {
+		if serr := SaveScanCache(); serr != nil {
+			WarnLog.Printf("Could not save the scan cache: %v", serr)
+		}
+
+		time.Sleep(WatchInterval)
+
+		var changed []*Package
+		for pkg, fp := range fingerprints {
+			if nfp := DirFingerprint(pkg.Dir); nfp != fp {
+				changed = append(changed, pkg)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		sort.Sort(byPkgTarget(changed))
+
+		resetStatus()
+
+		var rescanned []*Package
+		for _, old := range changed {
+			fmt.Printf("(in %s) changed\n", old.Dir)
+			delete(fingerprints, old)
+			pkg, rerr := Rescan(old)
+			if rerr != nil {
+				ErrLog.Printf("(in %s) %v", old.Dir, rerr)
+				// keep watching, in case it comes back
+				fingerprints[old] = DirFingerprint(old.Dir)
+				continue
+			}
+			fingerprints[pkg] = DirFingerprint(pkg.Dir)
+			rescanned = append(rescanned, pkg)
+		}
+
+		var allPkgs []*Package
+		for _, pkg := range Packages {
+			allPkgs = append(allPkgs, pkg)
+		}
+		if cerr := CycleError(FindCycles(allPkgs)); cerr != nil {
+			ErrLog.Printf("%v\n", cerr)
+			continue
+		}
+
+		affected := Affected(rescanned)
+		for pkg := range affected {
+			pkg.built = false
+			pkg.scanned = false
+			pkg.digested = false
+			pkg.FailedToBuild = false
+			pkg.NeedsBuild = false
+			pkg.NeedsInstall = false
+			pkg.Stat()
+		}
+
+		var targets []*Package
+		for _, pkg := range ListedPkgs {
+			if affected[pkg] {
+				targets = append(targets, pkg)
+			}
+		}
+		sort.Sort(byPkgTarget(targets))
+
+		if Build {
+			BuildTargets(targets)
+		}
+		if Test {
+			if terr := TestTargets(targets); terr != nil {
+				ErrLog.Printf("%v\n", terr)
+			}
+		}
+		if Install {
+			InstallTargets(targets)
+		}
+
+		PrintSummary()
+	}
+}
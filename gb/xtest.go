@@ -0,0 +1,142 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Test source may belong to packages other than the target's own, such as a
+black-box "foo_test" package, or a helper package that only the tests use.
+
+The target's own package is compiled first, together with its _test.go
+files, into _test/_obj/<target>.a. Since _test/_obj comes first in the
+include path, an external test package that imports the target's import
+path gets this archive. Each of the other test packages is then compiled
+into _test/_obj/<name>.a, after any others it imports by name.
+*/
+
+// ExternalTestPackages returns the names of the test packages other than
+// the target's own, ordered so that each comes after the ones it imports.
+func (this *Package) ExternalTestPackages() (names []string, err error) {
+	var sorted []string
+	for name := range this.TestSrc {
+		if name != this.Name {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) (err error) {
+		chain = append(chain, name)
+		switch state[name] {
+		case visiting:
+			err = errors.New(fmt.Sprintf("(in %s) test packages import each other: %s", this.Dir, strings.Join(chain, " -> ")))
+			return
+		case visited:
+			return
+		}
+		state[name] = visiting
+		deps := append([]string{}, this.TestPkgDeps[name]...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			depName := dep[1 : len(dep)-1]
+			if depName == name || depName == this.Name || this.TestSrc[depName] == nil {
+				continue
+			}
+			if err = visit(depName, chain); err != nil {
+				return
+			}
+		}
+		state[name] = visited
+		names = append(names, name)
+		return
+	}
+
+	for _, name := range sorted {
+		if err = visit(name, nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func inGOROOT(dep string) bool {
+	exists, _ := PkgExistsInGOROOT(dep)
+	return exists
+}
+
+// CheckTestPackages makes sure that the archives of the test packages will
+// not be mistaken for something else in _test/_obj.
+func (this *Package) CheckTestPackages() (err error) {
+	imports := make(map[string]bool)
+	for _, dep := range this.Deps {
+		imports[dep] = true
+	}
+	for _, dep := range this.TestDeps {
+		imports[dep] = true
+	}
+
+	var names []string
+	for name := range this.TestSrc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == this.Name {
+			continue
+		}
+		srcs := strings.Join(this.TestSrc[name], ", ")
+		quoted := "\"" + name + "\""
+		switch {
+		case name == this.Target:
+			err = errors.New(fmt.Sprintf("(in %s) test package %s in %s has the same import path as the target being tested", this.Dir, name, srcs))
+		case name == "main":
+			err = errors.New(fmt.Sprintf("(in %s) test source %s cannot be in package main", this.Dir, srcs))
+		case imports[quoted] || inGOROOT(quoted):
+			err = errors.New(fmt.Sprintf("(in %s) test package %s in %s would hide the package \"%s\"", this.Dir, name, srcs, name))
+		case Packages[quoted] != nil:
+			err = errors.New(fmt.Sprintf("(in %s) test package %s in %s has the same import path as the target in %s", this.Dir, name, srcs, Packages[quoted].Dir))
+		}
+		if err != nil {
+			return
+		}
+
+		if this.IsCmd {
+			for _, dep := range this.TestPkgDeps[name] {
+				if dep == this.ImportKey() || dep == "\""+this.Target+"\"" {
+					err = errors.New(fmt.Sprintf("(in %s) test package %s in %s cannot import \"%s\", which is a cmd", this.Dir, name, srcs, this.Target))
+					return
+				}
+			}
+		}
+	}
+	return
+}